@@ -0,0 +1,29 @@
+package authenticator
+
+import (
+	"encoding/json"
+
+	"github.com/willscott/sp3"
+)
+
+// ConsentTokenAuth authenticates with a consent token signed by the
+// destination ahead of time, without a live challenge.
+type ConsentTokenAuth struct {
+	Token *sp3.ConsentToken
+}
+
+func CreateConsentTokenAuth(token *sp3.ConsentToken) *ConsentTokenAuth {
+	return &ConsentTokenAuth{Token: token}
+}
+
+func (c *ConsentTokenAuth) Authenticate(done chan<- string) (sp3.AuthenticationMethod, []byte, error) {
+	data, err := json.Marshal(c.Token)
+	if err != nil {
+		return sp3.CONSENTTOKEN, nil, err
+	}
+	// The token is already the proof, so the challenge is known.
+	go func() {
+		done <- c.Token.Challenge()
+	}()
+	return sp3.CONSENTTOKEN, data, nil
+}
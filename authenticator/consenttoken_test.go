@@ -0,0 +1,36 @@
+package authenticator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/willscott/sp3"
+	"github.com/willscott/sp3/server/lib"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsentTokenAuthenticate(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	conf := server.Config{
+		PathReflectionFile: "../server/pathreflection.json",
+		ConsentKeys:        map[string]string{"127.0.0.1": base64.StdEncoding.EncodeToString(public)},
+	}
+	web := httptest.NewServer(server.SocketHandler(server.NewServer(conf, server.NewMemoryWriter(1))))
+	defer web.Close()
+
+	token, err := sp3.SignConsentToken(key, net.IP{127, 0, 0, 1}, sp3.ConsentScope{Expiry: time.Now().Add(time.Minute)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp3url := url.URL{Scheme: "ws", Host: strings.TrimPrefix(web.URL, "http://")}
+	conn, err := sp3.Dial(sp3url, net.IP{127, 0, 0, 1}, CreateConsentTokenAuth(token), nil)
+	if err != nil {
+		t.Fatal("Consent token not accepted", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,149 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/willscott/sp3"
+)
+
+// DNSReflectionAuth authenticates over UDP. It opens a binding with a
+// recursive resolver, which the SP3 server sends a query through carrying
+// the challenge. The resolver's answer echoes the query, bringing the
+// challenge back to the client.
+type DNSReflectionAuth struct {
+	resolvers []string
+	port      int // Port resolvers are reached on, 53 but in tests
+	clientIP  net.IP
+	conn      *net.UDPConn
+	done      chan<- string
+}
+
+// This should be kept in-sync with server/lib/dnsreflection
+type dnsReflectionState struct {
+	ResolverIP   net.IP
+	ResolverPort uint16
+	ClientIP     net.IP
+	ClientPort   uint16
+}
+
+// How long to wait for the resolver to answer the injected query, and how
+// many other answers to put up with meanwhile.
+const dnsReflectionTimeout = 30 * time.Second
+const maxDNSResponses = 16
+
+func CreateDNSReflectionAuthFromURL(sp3Url string, clientIP net.IP) (*DNSReflectionAuth, error) {
+	resp, err := http.Get(sp3Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	resolvers := []string{}
+	if err = json.NewDecoder(resp.Body).Decode(&resolvers); err != nil {
+		return nil, err
+	}
+	return CreateDNSReflectionAuth(resolvers, clientIP), nil
+}
+
+// CreateDNSReflectionAuth uses resolvers, the addresses of recursive
+// resolvers trusted by the SP3 server. The server only sends queries to port
+// 53, so resolvers given as host:port with another port are rejected. The
+// binding must keep its port through any NAT, since the server sends the
+// query from the client's local port.
+func CreateDNSReflectionAuth(resolvers []string, clientIP net.IP) *DNSReflectionAuth {
+	return &DNSReflectionAuth{resolvers: resolvers, port: 53, clientIP: clientIP}
+}
+
+func (d *DNSReflectionAuth) Authenticate(done chan<- string) (sp3.AuthenticationMethod, []byte, error) {
+	d.done = done
+	if len(d.resolvers) == 0 {
+		return sp3.DNSREFLECTION, nil, errors.New("No resolvers configured for reflection.")
+	}
+	resolver := d.resolvers[rand.Int()%len(d.resolvers)]
+	host, port, err := net.SplitHostPort(resolver)
+	if err != nil {
+		host = resolver
+	} else if port != "53" {
+		return sp3.DNSREFLECTION, nil, errors.New("Resolver " + resolver + " is not on port 53.")
+	}
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(d.port)))
+	if err != nil {
+		return sp3.DNSREFLECTION, nil, err
+	}
+	log.Printf("Binding will be to %s", addr)
+	if d.conn, err = net.DialUDP("udp4", nil, addr); err != nil {
+		return sp3.DNSREFLECTION, nil, err
+	}
+
+	// Open the binding with an ordinary query, whose answer is ignored.
+	query := &layers.DNS{
+		ID:     uint16(rand.Int()),
+		OpCode: layers.DNSOpCodeQuery,
+		RD:     true,
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte("invalid"),
+			Type:  layers.DNSTypeSOA,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err = query.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		d.conn.Close()
+		return sp3.DNSREFLECTION, nil, err
+	}
+	if _, err = d.conn.Write(buf.Bytes()); err != nil {
+		d.conn.Close()
+		return sp3.DNSREFLECTION, nil, err
+	}
+
+	state := dnsReflectionState{
+		ResolverIP:   addr.IP,
+		ResolverPort: uint16(addr.Port),
+		ClientIP:     d.clientIP,
+		ClientPort:   uint16(d.conn.LocalAddr().(*net.UDPAddr).Port),
+	}
+
+	// Set up the listener for the answer to the injected query.
+	go d.listen()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return sp3.DNSREFLECTION, nil, err
+	}
+	return sp3.DNSREFLECTION, data, nil
+}
+
+func (d *DNSReflectionAuth) listen() {
+	defer d.conn.Close()
+	d.conn.SetReadDeadline(time.Now().Add(dnsReflectionTimeout))
+	bufbytes := make([]byte, 4096)
+	for i := 0; i < maxDNSResponses; i++ {
+		n, err := d.conn.Read(bufbytes)
+		if err != nil {
+			log.Printf("Couldn't read DNS reflection answer: %v", err)
+			d.done <- ""
+			return
+		}
+		answer := &layers.DNS{}
+		if err := answer.DecodeFromBytes(bufbytes[0:n], gopacket.NilDecodeFeedback); err != nil || !answer.QR {
+			continue
+		}
+		// Answers and NXDOMAIN alike repeat the question.
+		for _, question := range answer.Questions {
+			if token, ok := sp3.DNSChallengeToken(string(question.Name)); ok {
+				d.done <- token
+				return
+			}
+		}
+	}
+	d.done <- ""
+}
@@ -0,0 +1,111 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/willscott/sp3"
+	"github.com/willscott/sp3/server/lib"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubResolver answers every query with NXDOMAIN.
+type stubResolver struct {
+	conn *net.UDPConn
+}
+
+func newStubResolver(t *testing.T) *stubResolver {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubResolver{conn}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			stub.answer(buf[0:n], from)
+		}
+	}()
+	return stub
+}
+
+func (s *stubResolver) answer(query []byte, to *net.UDPAddr) {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(query, gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	dns.QR = true
+	dns.RA = true
+	dns.ResponseCode = layers.DNSResponseCodeNXDomain
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err == nil {
+		s.conn.WriteToUDP(buf.Bytes(), to)
+	}
+}
+
+func TestDNSAuthenticate(t *testing.T) {
+	stub := newStubResolver(t)
+	defer stub.conn.Close()
+
+	writer := server.NewMemoryWriter(1)
+	conf := server.Config{PathReflectionFile: "../server/pathreflection.json", DNSResolvers: []string{"127.0.0.1"}}
+	serv := server.NewServer(conf, writer)
+	web := httptest.NewServer(server.DNSResolverHandler(serv))
+	defer web.Close()
+
+	auth, err := CreateDNSReflectionAuthFromURL(web.URL, net.IP{127, 0, 0, 1})
+	if err != nil {
+		t.Fatal("Could not create reflection auth from local server.", err)
+	}
+	auth.port = stub.conn.LocalAddr().(*net.UDPAddr).Port
+	done := make(chan string, 1)
+	mode, opts, err := auth.Authenticate(done)
+	if err != nil || mode != sp3.DNSREFLECTION {
+		t.Fatal("Authentication failed to start", err)
+	}
+
+	state := &server.DNSReflectionState{}
+	if err = json.Unmarshal(opts, state); err != nil {
+		t.Fatal("Could not understand auth opts", err)
+	}
+	challenge, err := serv.SendDNSReflectionChallenge(state)
+	if err != nil {
+		t.Fatal("Could not generate auth pkt", err)
+	}
+
+	// Deliver the spoofed query to the resolver, as if from the client.
+	packet := gopacket.NewPacket(<-writer.Packets, layers.LayerTypeIPv4, gopacket.Default)
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if ip == nil || udp == nil {
+		t.Fatal("Spoofed packet isn't UDP")
+	}
+	if udp.DstPort != layers.UDPPort(stub.conn.LocalAddr().(*net.UDPAddr).Port) {
+		t.Fatal("Query not sent to the resolver")
+	}
+	stub.answer(udp.Payload, &net.UDPAddr{IP: ip.SrcIP, Port: int(udp.SrcPort)})
+
+	select {
+	case token := <-done:
+		if token != challenge {
+			t.Fatal("Authentication extracted wrong token from answer.", token, challenge)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Challenge not reflected")
+	}
+}
+
+func TestDNSResolverPort(t *testing.T) {
+	// The server only sends queries to port 53.
+	auth := CreateDNSReflectionAuth([]string{"127.0.0.1:5353"}, net.IP{127, 0, 0, 1})
+	if _, _, err := auth.Authenticate(make(chan string, 1)); err == nil {
+		t.Fatal("Resolver on another port used")
+	}
+}
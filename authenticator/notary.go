@@ -0,0 +1,56 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/willscott/sp3"
+)
+
+// NotaryAuth authenticates with an attestation of the client's address from
+// a web notary, which the SP3 server must trust.
+type NotaryAuth struct {
+	Client *http.Client
+	url    string
+	server string
+}
+
+// CreateNotaryAuth uses the notary at notaryURL, for an attestation to the
+// SP3 server with the host name sp3Server.
+func CreateNotaryAuth(notaryURL string, sp3Server string) *NotaryAuth {
+	return &NotaryAuth{Client: http.DefaultClient, url: notaryURL, server: sp3Server}
+}
+
+func (n *NotaryAuth) Authenticate(done chan<- string) (sp3.AuthenticationMethod, []byte, error) {
+	notary, err := url.Parse(n.url)
+	if err != nil {
+		return sp3.WEBNOTARY, nil, err
+	}
+	query := notary.Query()
+	query.Set("server", n.server)
+	notary.RawQuery = query.Encode()
+	resp, err := n.Client.Get(notary.String())
+	if err != nil {
+		return sp3.WEBNOTARY, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return sp3.WEBNOTARY, nil, errors.New("Notary refused: " + resp.Status)
+	}
+	attestation := &sp3.NotaryAttestation{}
+	if err = json.NewDecoder(resp.Body).Decode(attestation); err != nil {
+		return sp3.WEBNOTARY, nil, err
+	}
+	data, err := json.Marshal(attestation)
+	if err != nil {
+		return sp3.WEBNOTARY, nil, err
+	}
+
+	// The attestation is already the proof, so the challenge is known.
+	go func() {
+		done <- attestation.Challenge()
+	}()
+	return sp3.WEBNOTARY, data, nil
+}
@@ -0,0 +1,47 @@
+package authenticator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/willscott/sp3"
+	"github.com/willscott/sp3/server/lib"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNotaryAuthenticate(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	notary := httptest.NewServer(server.NotaryHandler(key, ""))
+	defer notary.Close()
+
+	// The server is named by the address it listens on.
+	web := httptest.NewUnstartedServer(nil)
+	conf := server.Config{
+		PathReflectionFile: "../server/pathreflection.json",
+		ServerName:         web.Listener.Addr().String(),
+		NotaryKeys:         []string{base64.StdEncoding.EncodeToString(public)},
+	}
+	web.Config.Handler = server.SocketHandler(server.NewServer(conf, server.NewMemoryWriter(1)))
+	web.Start()
+	defer web.Close()
+
+	// The notary sees the client as 127.0.0.1, which the attestation lets
+	// it send to.
+	sp3url := url.URL{Scheme: "ws", Host: strings.TrimPrefix(web.URL, "http://")}
+	conn, err := sp3.Dial(sp3url, net.IP{127, 0, 0, 1}, CreateNotaryAuth(notary.URL, sp3url.Host), nil)
+	if err != nil {
+		t.Fatal("Attestation not accepted", err)
+	}
+	conn.Close()
+
+	if _, err = sp3.Dial(sp3url, net.IP{127, 0, 0, 2}, CreateNotaryAuth(notary.URL, sp3url.Host), nil); err == nil {
+		t.Fatal("Attestation accepted for another address")
+	}
+	if _, err = sp3.Dial(sp3url, net.IP{127, 0, 0, 1}, CreateNotaryAuth(notary.URL, "other.example"), nil); err == nil {
+		t.Fatal("Attestation accepted for another server")
+	}
+}
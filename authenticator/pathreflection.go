@@ -12,13 +12,12 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
-
-	"strings"
 )
 
 type PathReflectionAuth struct {
 	Dialer   proxy.Dialer
-	servers  map[string]string
+	servers  map[string]sp3.ReflectorProfile
+	profile  sp3.ReflectorProfile
 	clientIP net.IP
 	conn     net.Conn
 	done     chan<- string
@@ -45,19 +44,17 @@ func CreatePathReflectionAuthFromURL(sp3Url string, clientIP net.IP) (*PathRefle
 	}
 	defer resp.Body.Close()
 
-	servers := map[string]interface{}{}
+	servers := map[string]sp3.ReflectorProfile{}
 	err = json.NewDecoder(resp.Body).Decode(&servers)
 	if err != nil {
 		return nil, err
 	}
-	typedServers := make(map[string]string)
-	for k := range servers {
-		typedServers[k] = k
-	}
-	return CreatePathReflectionAuth(typedServers, clientIP), nil
+	return CreatePathReflectionAuth(servers, clientIP), nil
 }
 
-func CreatePathReflectionAuth(servers map[string]string, clientIP net.IP) *PathReflectionAuth {
+// CreatePathReflectionAuth uses servers, a map from the IP address of each
+// reflector to its profile, as published by the SP3 server.
+func CreatePathReflectionAuth(servers map[string]sp3.ReflectorProfile, clientIP net.IP) *PathReflectionAuth {
 	pra := new(PathReflectionAuth)
 	pra.clientIP = clientIP
 	pra.servers = servers
@@ -74,9 +71,10 @@ func (p *PathReflectionAuth) Authenticate(done chan<- string) (sp3.Authenticatio
 		return sp3.PATHREFLECTION, nil, errors.New("No servers configured for reflection.")
 	} else {
 		pos := rand.Int() % len(p.servers)
-		for k := range p.servers {
+		for k, profile := range p.servers {
 			if pos == 0 {
 				addr = k
+				p.profile = profile
 				break
 			}
 			pos -= 1
@@ -94,12 +92,11 @@ func (p *PathReflectionAuth) Authenticate(done chan<- string) (sp3.Authenticatio
 
 	// TCP Handshake
 	state := pathReflectionState{
-		p.clientIP,
-		uint16(IP_LOCAL_PORT_LOW + rand.Int()%(IP_LOCAL_PORT_HIGH-IP_LOCAL_PORT_LOW)),
-		net.ParseIP(addr),
-		uint16(80),
-		uint32(rand.Int()),
-		0,
+		ServerIP:       net.ParseIP(addr),
+		ServerPort:     p.profile.ServerPort(),
+		ClientIP:       p.clientIP,
+		ClientPort:     uint16(IP_LOCAL_PORT_LOW + rand.Int()%(IP_LOCAL_PORT_HIGH-IP_LOCAL_PORT_LOW)),
+		SequenceNumber: uint32(rand.Int()),
 	}
 
 	iplayer := &layers.IPv4{
@@ -119,19 +116,12 @@ func (p *PathReflectionAuth) Authenticate(done chan<- string) (sp3.Authenticatio
 		SYN:     true,
 	}
 
-	buf := gopacket.NewSerializeBuffer()
-	tcplayer.SetNetworkLayerForChecksum(iplayer)
-	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
-		ComputeChecksums: true,
-		FixLengths:       true,
-	}, tcplayer)
-	if err != nil {
-		return sp3.PATHREFLECTION, nil, err
-	}
 	log.Printf("About to write SYN")
-	if _, err = p.conn.Write(buf.Bytes()); err != nil {
+	if err = p.send(iplayer, tcplayer); err != nil {
 		return sp3.PATHREFLECTION, nil, err
 	}
+	// The SYN takes up a sequence number.
+	state.SequenceNumber++
 
 	// Wait for a syn-ack to learn server's squence number.
 	log.Printf("Waiting for SYN-ACK")
@@ -148,6 +138,27 @@ func (p *PathReflectionAuth) Authenticate(done chan<- string) (sp3.Authenticatio
 		return sp3.PATHREFLECTION, nil, errors.New("SYNACK not understood.")
 	}
 
+	// Reflectors which speak first don't expect the request before their
+	// greeting, so the handshake is finished and the request injected after
+	// it.
+	if p.profile.Greeting() {
+		ack := &layers.TCP{
+			SrcPort: layers.TCPPort(state.ClientPort),
+			DstPort: layers.TCPPort(state.ServerPort),
+			Window:  4380,
+			Seq:     state.SequenceNumber,
+			Ack:     state.AcknowledgementNumber,
+			ACK:     true,
+		}
+		if err = p.send(iplayer, ack); err != nil {
+			return sp3.PATHREFLECTION, nil, err
+		}
+		log.Printf("Waiting for greeting")
+		if state.AcknowledgementNumber, err = p.readGreeting(state); err != nil {
+			return sp3.PATHREFLECTION, nil, err
+		}
+	}
+
 	// Set up the listener for server response to injected query.
 	go p.listen()
 
@@ -159,38 +170,76 @@ func (p *PathReflectionAuth) Authenticate(done chan<- string) (sp3.Authenticatio
 	return sp3.PATHREFLECTION, data, nil
 }
 
+// Packets of the reflected response are read until the token turns up, in the
+// place the reflector's profile says it will be.
+const maxReflectedPackets = 16
+
 func (p *PathReflectionAuth) listen() {
+	response := []byte{}
 	bufbytes := make([]byte, 2048)
-	respn, err := p.conn.Read(bufbytes)
-	log.Printf("Path Reflection got an incoming packet.")
-	if err != nil {
-		log.Printf("Couldn't read path reflection packet: %v", err)
-		p.done <- ""
-		return
-	}
-	rpkt := gopacket.NewPacket(bufbytes[0:respn], layers.LayerTypeTCP, gopacket.Default)
-	if payload := rpkt.ApplicationLayer(); payload != nil {
-		strpayload := string(payload.Payload())
-		idx := strings.Index(strpayload, "sp3.")
-		if idx == -1 {
+	for i := 0; i < maxReflectedPackets; i++ {
+		respn, err := p.conn.Read(bufbytes)
+		log.Printf("Path Reflection got an incoming packet.")
+		if err != nil {
+			log.Printf("Couldn't read path reflection packet: %v", err)
 			p.done <- ""
 			return
 		}
-		idx += 4
-		end := strings.IndexFunc(strpayload[idx:], isbase64)
-		if end == -1 {
-			p.done <- ""
+		rpkt := gopacket.NewPacket(bufbytes[0:respn], layers.LayerTypeTCP, gopacket.Default)
+		payload := rpkt.ApplicationLayer()
+		if payload == nil {
+			log.Printf("Couldn't parse packet: %v", rpkt.ErrorLayer())
+			continue
+		}
+		response = append(response, payload.Payload()...)
+		if token, ok := p.profile.FindToken(response); ok {
+			p.done <- token
 			return
 		}
-		p.done <- strpayload[idx : idx+end]
-	} else {
-		err := rpkt.ErrorLayer()
-		log.Printf("Couldn't parse packet!", err)
-		p.done <- ""
 	}
+	p.done <- ""
+}
+
+// send writes a TCP segment, with its checksum computed for iplayer.
+func (p *PathReflectionAuth) send(iplayer *layers.IPv4, tcplayer *layers.TCP) error {
+	buf := gopacket.NewSerializeBuffer()
+	tcplayer.SetNetworkLayerForChecksum(iplayer)
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}, tcplayer)
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.Write(buf.Bytes())
+	return err
 }
 
-func isbase64(c rune) bool {
-	val := (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
-	return !val
+// readGreeting reads the reflector's greeting, returning the sequence number
+// which follows it.
+func (p *PathReflectionAuth) readGreeting(state pathReflectionState) (uint32, error) {
+	greeting := []byte{}
+	next := state.AcknowledgementNumber
+	bufbytes := make([]byte, 2048)
+	for i := 0; i < maxReflectedPackets; i++ {
+		respn, err := p.conn.Read(bufbytes)
+		if err != nil {
+			return 0, err
+		}
+		rpkt := gopacket.NewPacket(bufbytes[0:respn], layers.LayerTypeTCP, gopacket.Default)
+		tcpLayer := rpkt.Layer(layers.LayerTypeTCP)
+		if tcpLayer == nil {
+			continue
+		}
+		tcp, _ := tcpLayer.(*layers.TCP)
+		if uint16(tcp.SrcPort) != state.ServerPort || uint16(tcp.DstPort) != state.ClientPort || tcp.Seq != next || len(tcp.Payload) == 0 {
+			continue
+		}
+		greeting = append(greeting, tcp.Payload...)
+		next += uint32(len(tcp.Payload))
+		if p.profile.GreetingEnd(greeting) > 0 {
+			return next, nil
+		}
+	}
+	return 0, errors.New("Greeting not received.")
 }
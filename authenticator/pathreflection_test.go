@@ -2,10 +2,13 @@ package authenticator
 
 import (
 	"encoding/json"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/willscott/sp3"
 	"github.com/willscott/sp3/server/lib"
 	"net"
 	"testing"
+	"time"
 )
 
 type MockDialer struct {
@@ -17,15 +20,20 @@ func (m *MockDialer) Dial(network, address string) (net.Conn, error) {
 }
 
 func TestAuthenticate(t *testing.T) {
-	servconf := server.Config{8888, "eth0", "0", "0", "../server/pathreflection.json"}
-	serv := server.NewServer(servconf)
+	servconf := server.Config{Port: 8888, PathReflectionFile: "../server/pathreflection.json"}
+	writer := server.NewMemoryWriter(1)
+	serv := server.NewServer(servconf, writer)
 	if serv == nil {
 		t.Fatal("Could not start server.")
 	}
 	go serv.Serve()
 
-	// Create path reflection authenticator.
+	// Create path reflection authenticator, once the server is listening.
 	auth, err := CreatePathReflectionAuthFromURL("http://localhost:8888/pathreflection.json", net.IP{0, 0, 0, 0})
+	for i := 0; i < 50 && err != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		auth, err = CreatePathReflectionAuthFromURL("http://localhost:8888/pathreflection.json", net.IP{0, 0, 0, 0})
+	}
 	if err != nil {
 		t.Fatal("Could not create reflection auth from local server.", err)
 	}
@@ -54,18 +62,17 @@ func TestAuthenticate(t *testing.T) {
 	}
 
 	// Send the injected packet.
-	server.TestSpoofChannel = make(chan []byte, 1)
 	decodeopts := &server.PathReflectionState{}
 	if err = json.Unmarshal(opts, decodeopts); err != nil {
 		t.Fatal("Could not understand auth opts", err)
 	}
-	challenge, err := server.SendPathReflectionChallenge(servconf, decodeopts)
+	challenge, err := serv.SendPathReflectionChallenge(decodeopts)
 	if err != nil {
 		t.Fatal("Could not generate auth pkg", err)
 	}
 
 	// Strip off the ip header.
-	injectPkt := <-server.TestSpoofChannel
+	injectPkt := <-writer.Packets
 	authConnServer.Write(injectPkt[20:])
 
 	// auth should now be done
@@ -74,3 +81,91 @@ func TestAuthenticate(t *testing.T) {
 		t.Fatal("Authentication extracted wrong token from response.")
 	}
 }
+
+func TestAuthenticateWithProfile(t *testing.T) {
+	profile := sp3.ReflectorProfile{Port: 8080, Path: "/r?q={token}", Extraction: `Location: [^\r]*t=([A-Za-z0-9]+)`}
+	auth := CreatePathReflectionAuth(map[string]sp3.ReflectorProfile{"1.2.3.4": profile}, net.ParseIP("5.6.7.8"))
+	authClientConn, authConnServer := net.Pipe()
+	auth.Dialer = &MockDialer{authClientConn}
+
+	// Answer the syn with itself, as in TestAuthenticate.
+	go func() {
+		syn := make([]byte, 2048)
+		n, err := authConnServer.Read(syn)
+		if err == nil {
+			authConnServer.Write(syn[0:n])
+		}
+	}()
+	done := make(chan string, 1)
+	_, opts, err := auth.Authenticate(done)
+	if err != nil {
+		t.Fatal("Could not begin auth process", err)
+	}
+	state := &server.PathReflectionState{}
+	if err = json.Unmarshal(opts, state); err != nil || state.ServerPort != 8080 || !state.ServerIP.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatal("State doesn't follow the profile", state, err)
+	}
+
+	// The reflector's reply carries the token where the profile says.
+	buf := gopacket.NewSerializeBuffer()
+	tcp := &layers.TCP{SrcPort: 8080, DstPort: layers.TCPPort(state.ClientPort), ACK: true, DataOffset: 5}
+	reply := gopacket.Payload([]byte("HTTP/1.1 302 Found\r\nLocation: /results?t=tok123\r\n\r\n"))
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, tcp, reply); err != nil {
+		t.Fatal(err)
+	}
+	authConnServer.Write(buf.Bytes())
+	if token := <-done; token != "tok123" {
+		t.Fatal("Token not extracted with the profile", token)
+	}
+}
+
+func TestAuthenticateAfterGreeting(t *testing.T) {
+	profile := sp3.ReflectorProfile{Protocol: sp3.SMTP}
+	auth := CreatePathReflectionAuth(map[string]sp3.ReflectorProfile{"1.2.3.4": profile}, net.ParseIP("5.6.7.8"))
+	authClientConn, authConnServer := net.Pipe()
+	auth.Dialer = &MockDialer{authClientConn}
+
+	// segment serializes a packet from the reflector.
+	segment := func(clientPort layers.TCPPort, syn bool, seq uint32, payload string) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		tcp := &layers.TCP{SrcPort: 25, DstPort: clientPort, Seq: seq, SYN: syn, ACK: true, DataOffset: 5}
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, tcp, gopacket.Payload(payload)); err != nil {
+			t.Error(err)
+		}
+		return buf.Bytes()
+	}
+	handshake := make(chan *layers.TCP, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		n, err := authConnServer.Read(buf)
+		if err != nil {
+			return
+		}
+		syn := gopacket.NewPacket(buf[0:n], layers.LayerTypeTCP, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+		authConnServer.Write(segment(syn.SrcPort, true, 1000, ""))
+		if n, err = authConnServer.Read(buf); err != nil {
+			return
+		}
+		handshake <- gopacket.NewPacket(buf[0:n], layers.LayerTypeTCP, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+		authConnServer.Write(segment(syn.SrcPort, false, 1001, "220-mail.example\r\n"))
+		authConnServer.Write(segment(syn.SrcPort, false, 1019, "220 ESMTP\r\n"))
+	}()
+	done := make(chan string, 1)
+	_, opts, err := auth.Authenticate(done)
+	if err != nil {
+		t.Fatal("Could not begin auth process", err)
+	}
+	ack := <-handshake
+	if !ack.ACK || ack.SYN || ack.Ack != 1001 {
+		t.Fatal("Handshake not finished", ack)
+	}
+
+	// The request is injected after the greeting, and the SYN.
+	state := &server.PathReflectionState{}
+	if err = json.Unmarshal(opts, state); err != nil {
+		t.Fatal("Could not understand auth opts", err)
+	}
+	if state.AcknowledgementNumber != 1030 || state.SequenceNumber != ack.Seq {
+		t.Fatal("Request wouldn't follow the greeting", state)
+	}
+}
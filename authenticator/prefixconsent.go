@@ -0,0 +1,33 @@
+package authenticator
+
+import (
+	"encoding/json"
+
+	"github.com/willscott/sp3"
+)
+
+// PrefixConsentAuth authenticates with consent published by the operator of
+// a prefix containing the destination in DNS, or by the destination itself on
+// Host.
+type PrefixConsentAuth struct {
+	Options sp3.PrefixConsentOptions
+}
+
+// CreatePrefixConsentAuth uses the consent of prefix, found in DNS if host is
+// empty, and otherwise at https://host/.well-known/sp3-consent, when prefix
+// must be the host's own address.
+func CreatePrefixConsentAuth(prefix string, host string) *PrefixConsentAuth {
+	return &PrefixConsentAuth{sp3.PrefixConsentOptions{Prefix: prefix, Host: host}}
+}
+
+func (p *PrefixConsentAuth) Authenticate(done chan<- string) (sp3.AuthenticationMethod, []byte, error) {
+	data, err := json.Marshal(p.Options)
+	if err != nil {
+		return sp3.PREFIXCONSENT, nil, err
+	}
+	// The published record is the proof, and the prefix the challenge.
+	go func() {
+		done <- p.Options.Prefix
+	}()
+	return sp3.PREFIXCONSENT, data, nil
+}
@@ -0,0 +1,124 @@
+package authenticator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// StunAuth authenticates with a UDP binding. It asks a STUN server for the
+// client's external address, and the SP3 server then sends a Binding
+// Response through the binding, as if from the STUN server, whose
+// transaction ID is the challenge.
+type StunAuth struct {
+	server string
+	conn   *net.UDPConn
+	done   chan<- string
+}
+
+// This should be kept in-sync with server/lib/stuninjection
+type stunInjectionState struct {
+	ServerIP   net.IP
+	ServerPort uint16
+	ClientIP   net.IP
+	ClientPort uint16
+}
+
+// How long to wait for each answer of the STUN server, how many times to ask,
+// and how long to wait for the challenge.
+const stunRequestTimeout = 2 * time.Second
+const stunRequestAttempts = 3
+const stunChallengeTimeout = 30 * time.Second
+
+// CreateStunAuth uses the STUN server at host:port.
+func CreateStunAuth(server string) *StunAuth {
+	return &StunAuth{server: server}
+}
+
+func (s *StunAuth) Authenticate(done chan<- string) (sp3.AuthenticationMethod, []byte, error) {
+	s.done = done
+	addr, err := net.ResolveUDPAddr("udp4", s.server)
+	if err != nil {
+		return sp3.STUNINJECTION, nil, err
+	}
+	if s.conn, err = net.DialUDP("udp4", nil, addr); err != nil {
+		return sp3.STUNINJECTION, nil, err
+	}
+
+	var request sp3.StunTransactionID
+	if _, err = rand.Read(request[:]); err != nil {
+		s.conn.Close()
+		return sp3.STUNINJECTION, nil, err
+	}
+	mapped, err := s.bind(request)
+	if err != nil {
+		s.conn.Close()
+		return sp3.STUNINJECTION, nil, err
+	}
+	log.Printf("STUN server %s sees us as %s", addr, mapped)
+
+	state := stunInjectionState{
+		ServerIP:   addr.IP,
+		ServerPort: uint16(addr.Port),
+		ClientIP:   mapped.IP,
+		ClientPort: uint16(mapped.Port),
+	}
+
+	// Set up the listener for the injected response.
+	go s.listen(request)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return sp3.STUNINJECTION, nil, err
+	}
+	return sp3.STUNINJECTION, data, nil
+}
+
+// bind learns the external address of the binding.
+func (s *StunAuth) bind(request sp3.StunTransactionID) (*net.UDPAddr, error) {
+	bufbytes := make([]byte, 1500)
+	for i := 0; i < stunRequestAttempts; i++ {
+		if _, err := s.conn.Write(sp3.StunBindingRequest(request)); err != nil {
+			return nil, err
+		}
+		s.conn.SetReadDeadline(time.Now().Add(stunRequestTimeout))
+		for {
+			n, err := s.conn.Read(bufbytes)
+			if err != nil {
+				break
+			}
+			id, mapped, err := sp3.ParseStunBindingResponse(bufbytes[0:n])
+			if err == nil && id == request && mapped != nil {
+				return mapped, nil
+			}
+		}
+	}
+	return nil, errors.New("No answer from STUN server.")
+}
+
+func (s *StunAuth) listen(request sp3.StunTransactionID) {
+	defer s.conn.Close()
+	s.conn.SetReadDeadline(time.Now().Add(stunChallengeTimeout))
+	bufbytes := make([]byte, 1500)
+	for {
+		n, err := s.conn.Read(bufbytes)
+		if err != nil {
+			log.Printf("Couldn't read STUN challenge: %v", err)
+			s.done <- ""
+			return
+		}
+		// Answers to our own request may be repeated.
+		id, _, err := sp3.ParseStunBindingResponse(bufbytes[0:n])
+		if err != nil || id == request {
+			continue
+		}
+		s.done <- hex.EncodeToString(id[:])
+		return
+	}
+}
@@ -0,0 +1,80 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/willscott/sp3"
+	"github.com/willscott/sp3/server/lib"
+	"net"
+	"testing"
+	"time"
+)
+
+// stubStunServer answers Binding Requests with the address they came from.
+func stubStunServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 {
+				continue
+			}
+			var id sp3.StunTransactionID
+			copy(id[:], buf[8:20])
+			conn.WriteToUDP(sp3.StunBindingResponse(id, from), from)
+		}
+	}()
+	return conn
+}
+
+func TestStunAuthenticate(t *testing.T) {
+	stun := stubStunServer(t)
+	defer stun.Close()
+
+	auth := CreateStunAuth(stun.LocalAddr().String())
+	done := make(chan string, 1)
+	mode, opts, err := auth.Authenticate(done)
+	if err != nil || mode != sp3.STUNINJECTION {
+		t.Fatal("Authentication failed to start", err)
+	}
+	state := &server.StunInjectionState{}
+	if err = json.Unmarshal(opts, state); err != nil {
+		t.Fatal("Could not understand auth opts", err)
+	}
+	if !state.ClientIP.Equal(net.IP{127, 0, 0, 1}) || state.ClientPort == 0 {
+		t.Fatal("Mapped address not learned", state)
+	}
+
+	writer := server.NewMemoryWriter(1)
+	serv := server.NewServer(server.Config{PathReflectionFile: "../server/pathreflection.json"}, writer)
+	challenge, err := serv.SendStunChallenge(state)
+	if err != nil {
+		t.Fatal("Could not generate auth pkt", err)
+	}
+
+	// Deliver the spoofed response, from the STUN server's address.
+	packet := gopacket.NewPacket(<-writer.Packets, layers.LayerTypeIPv4, gopacket.Default)
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if ip == nil || udp == nil || !ip.SrcIP.Equal(state.ServerIP) || uint16(udp.SrcPort) != state.ServerPort {
+		t.Fatal("Response not spoofed from the STUN server")
+	}
+	stun.WriteToUDP(udp.Payload, &net.UDPAddr{IP: ip.DstIP, Port: int(udp.DstPort)})
+
+	select {
+	case token := <-done:
+		if token != challenge {
+			t.Fatal("Authentication extracted wrong token from response.", token, challenge)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Challenge not received")
+	}
+}
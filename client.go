@@ -1,11 +1,14 @@
 package sp3
 
 import (
+	"crypto/ecdh"
 	"errors"
 	"github.com/gorilla/websocket"
 	"log"
 	"net"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -24,8 +27,9 @@ func Dial(sp3server url.URL, destination net.IP, auth Authenticator, dialer *web
 		dialer = websocket.DefaultDialer
 	}
 
-	conn := &Sp3Conn{}
+	conn := &Sp3Conn{auth: auth}
 	conn.incomingMessage = make(chan ServerMessage)
+	conn.closed = make(chan struct{})
 	conn.destination = &net.IPAddr{IP: destination}
 	conn.Conn, _, err = dialer.Dial(sp3server.String(), nil)
 	if err != nil {
@@ -34,10 +38,32 @@ func Dial(sp3server url.URL, destination net.IP, auth Authenticator, dialer *web
 
 	// Send SenderHello.
 	hello := &SenderHello{
-		destination.String(),
-		mode,
-		opts,
+		DestinationAddress:    destination.String(),
+		AuthenticationMethod:  mode,
+		AuthenticationOptions: opts,
 	}
+
+	if described, ok := auth.(DescribedAuthenticator); ok {
+		hello.Purpose, hello.Limits = described.Describe()
+	}
+
+	// Consent to receive packets first, if the sender is also the client.
+	// Otherwise the client relays the challenge, sealed to a key of our own.
+	var mailboxKey *ecdh.PrivateKey
+	if consenting, ok := auth.(ConsentingAuthenticator); ok {
+		clientHello := consenting.Consent()
+		if err = conn.Conn.WriteJSON(&ClientMessage{Hello: &clientHello}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else if mode == WEBSOCKET {
+		if mailboxKey, err = NewMailboxKey(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		hello.PublicKey = mailboxKey.PublicKey().Bytes()
+	}
+
 	err = conn.Conn.WriteJSON(hello)
 	if err != nil {
 		conn.Close()
@@ -68,12 +94,24 @@ AuthLoop:
 		case msg := <-conn.incomingMessage:
 			if msg.Status != OKAY {
 				conn.Close()
-				return nil, errors.New("Server closed connection with status: " + string(int(msg.Status)))
+				if msg.Error != nil {
+					return nil, msg.Error
+				}
+				return nil, errors.New("Server closed connection with status: " + strconv.Itoa(int(msg.Status)))
 			} else if mode == WEBSOCKET && len(msg.Challenge) > 0 {
 				// On another thread to prevent blocking.
 				go func() {
 					finished <- msg.Challenge
 				}()
+			} else if mailboxKey != nil && len(msg.Sealed) > 0 {
+				challenge, err := OpenChallenge(mailboxKey, msg.Sealed)
+				if err != nil {
+					log.Printf("Couldn't open relayed challenge: %v", err)
+					continue
+				}
+				go func() {
+					finished <- challenge
+				}()
 			}
 		}
 	}
@@ -82,7 +120,10 @@ AuthLoop:
 	msg := <-conn.incomingMessage
 	if msg.Status != OKAY {
 		conn.Close()
-		return nil, errors.New("Server rejected authentication (" + string(int(msg.Status)) + ") " + msg.Challenge)
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return nil, errors.New("Server rejected authentication (" + strconv.Itoa(int(msg.Status)) + ") " + msg.Challenge)
 	}
 
 	// Watch for incoming errors.
@@ -101,8 +142,31 @@ type Authenticator interface {
 	Authenticate(chan<- string) (AuthenticationMethod, []byte, error)
 }
 
+/**
+ * A ConsentingAuthenticator is run from the destination itself, and so gives
+ * the consent of the client on the same connection before authenticating.
+ */
+type ConsentingAuthenticator interface {
+	Authenticator
+	Consent() ClientHello
+}
+
+/**
+ * A DescribedAuthenticator tells clients which approve senders why it wants
+ * to send, and the limits it asks to be held to, which may be nil.
+ */
+type DescribedAuthenticator interface {
+	Authenticator
+	Describe() (purpose string, limits *ConsentScope)
+}
+
+/**
+ * DirectAuth authenticates a sender running at the destination, which
+ * consents to receive packets within Scope.
+ */
 type DirectAuth struct {
-	done chan<- string
+	Scope ConsentScope
+	done  chan<- string
 }
 
 func (d DirectAuth) Authenticate(done chan<- string) (AuthenticationMethod, []byte, error) {
@@ -110,11 +174,51 @@ func (d DirectAuth) Authenticate(done chan<- string) (AuthenticationMethod, []by
 	return WEBSOCKET, []byte{}, nil
 }
 
+func (d DirectAuth) Consent() ClientHello {
+	return ClientHello{Scope: d.Scope}
+}
+
+/**
+ * RelayedAuth authenticates a sender on another host than the destination,
+ * through a client at the destination which consents over its own websocket
+ * and relays the challenge to the server's mailbox.
+ */
+type RelayedAuth struct {
+	Purpose string
+	Limits  *ConsentScope
+}
+
+func (r RelayedAuth) Authenticate(done chan<- string) (AuthenticationMethod, []byte, error) {
+	return WEBSOCKET, []byte{}, nil
+}
+
+func (r RelayedAuth) Describe() (string, *ConsentScope) {
+	return r.Purpose, r.Limits
+}
+
 type Sp3Conn struct {
 	*websocket.Conn
+	auth            Authenticator
 	destination     net.Addr
 	incomingMessage chan ServerMessage
+	closed          chan struct{} // Closed once the connection to the server ends
 	lastError       error
+	errorLock       sync.Mutex
+	writeLock       sync.Mutex
+}
+
+// The loops reading from the server record why the connection ended, while
+// the caller may be using it.
+func (s *Sp3Conn) setError(err error) {
+	s.errorLock.Lock()
+	defer s.errorLock.Unlock()
+	s.lastError = err
+}
+
+func (s *Sp3Conn) err() error {
+	s.errorLock.Lock()
+	defer s.errorLock.Unlock()
+	return s.lastError
 }
 
 func (s *Sp3Conn) readLoop() {
@@ -123,7 +227,8 @@ func (s *Sp3Conn) readLoop() {
 		err := s.Conn.ReadJSON(msg)
 		if err != nil {
 			close(s.incomingMessage)
-			s.lastError = err
+			s.setError(err)
+			close(s.closed)
 			break
 		}
 		s.incomingMessage <- *msg
@@ -133,18 +238,73 @@ func (s *Sp3Conn) readLoop() {
 func (s *Sp3Conn) watchLoop() {
 	for {
 		msg, ok := <-s.incomingMessage
-		if msg.Status != OKAY || !ok {
-			if ok {
-				s.Close()
-				s.lastError = errors.New("Server Closed Connection: " + string(int(msg.Status)))
-			} else {
-				s.lastError = errors.New("Network Connection Closed")
-			}
+		if !ok {
+			s.setError(errors.New("Network Connection Closed"))
+			return
+		}
+		switch msg.Status {
+		case OKAY:
+		case REAUTHENTICATE:
+			go s.reauthenticate()
+		case SUSPENDED:
+			log.Printf("Sending suspended until authentication completes.")
+		case REVOKED:
+			s.Close()
+			s.setError(errors.New("Destination revoked consent"))
+			return
+		default:
+			s.Close()
+			s.setError(errors.New("Server Closed Connection: " + strconv.Itoa(int(msg.Status))))
 			return
 		}
 	}
 }
 
+// How long reauthentication waits for the authenticator to find the
+// challenge. The server asks again if it times out.
+const reauthenticationTimeout = 30 * time.Second
+
+/**
+ * Authentication methods other than WEBSOCKET are periodically repeated, to
+ * show the sender is still able to authenticate. The server's acknowledgement
+ * arrives through the watchLoop.
+ */
+func (s *Sp3Conn) reauthenticate() {
+	// Buffered, so an authenticator finishing after we stop waiting isn't
+	// left blocked.
+	finished := make(chan string, 1)
+	mode, opts, err := s.auth.Authenticate(finished)
+	if err != nil {
+		log.Printf("Couldn't reauthenticate: %v", err)
+		return
+	}
+	destination := extractHost(s.destination)
+	if err = s.writeJSON(&SenderHello{DestinationAddress: destination, AuthenticationMethod: mode, AuthenticationOptions: opts}); err != nil {
+		return
+	}
+	var challenge string
+	select {
+	case challenge = <-finished:
+	case <-time.After(reauthenticationTimeout):
+		log.Printf("Reauthentication timed out.")
+		return
+	case <-s.closed:
+		return
+	}
+	if len(challenge) == 0 {
+		log.Printf("Reauthentication failed.")
+		return
+	}
+	s.writeJSON(&SenderAuthorization{destination, challenge})
+}
+
+// Only one write to the websocket may happen at a time.
+func (s *Sp3Conn) writeJSON(msg interface{}) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.Conn.WriteJSON(msg)
+}
+
 func (s *Sp3Conn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 	return 0, nil, errors.New("SP3 Connections do not receive data.")
 }
@@ -162,10 +322,12 @@ func (s *Sp3Conn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 		log.Printf("Invalid Destination %v vs %v", extractHost(addr), extractHost(s.destination))
 		return 0, errors.New("Invalid Destination")
 	}
-	if s.lastError != nil {
-		return 0, s.lastError
+	if err := s.err(); err != nil {
+		return 0, err
 	}
+	s.writeLock.Lock()
 	err = s.Conn.WriteMessage(websocket.BinaryMessage, b)
+	s.writeLock.Unlock()
 	if err != nil {
 		return 0, err
 	}
@@ -173,8 +335,8 @@ func (s *Sp3Conn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
 }
 
 func (s *Sp3Conn) Close() error {
-	if s.lastError != nil {
-		return s.lastError
+	if err := s.err(); err != nil {
+		return err
 	}
 	return s.Conn.Close()
 }
@@ -184,8 +346,8 @@ func (s *Sp3Conn) LocalAddr() net.Addr {
 }
 
 func (s *Sp3Conn) SetDeadline(t time.Time) error {
-	if s.lastError != nil {
-		return s.lastError
+	if err := s.err(); err != nil {
+		return err
 	}
 	return s.Conn.SetWriteDeadline(t)
 }
@@ -195,8 +357,8 @@ func (s *Sp3Conn) SetReadDeadline(t time.Time) error {
 }
 
 func (s *Sp3Conn) SetWriteDeadline(t time.Time) error {
-	if s.lastError != nil {
-		return s.lastError
+	if err := s.err(); err != nil {
+		return err
 	}
 	return s.Conn.SetWriteDeadline(t)
 }
@@ -0,0 +1,213 @@
+package sp3
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/**
+ * Consent tokens let a client consent ahead of time, without staying
+ * connected. The client signs its address and a scope with a key, which is
+ * either configured at the server, or registered with it: the client proves
+ * it holds the key over a consent websocket, and the server signs a
+ * ConsentRegistration tying the key to the address. Other servers which trust
+ * the registering server's key accept the same tokens.
+ */
+
+// ConsentKeyProof registers a key. It is first sent without a signature, and
+// then again signing the challenge the server answers with.
+type ConsentKeyProof struct {
+	Key       []byte
+	Signature []byte `json:",omitempty"`
+}
+
+// A ConsentRegistration is a server's statement that Key may consent for
+// Address, until Expiry.
+type ConsentRegistration struct {
+	Address   string
+	Key       []byte
+	Expiry    int64  // Unix seconds
+	Registrar []byte // The public key of the server which signed it
+	Signature []byte
+}
+
+// A ConsentToken is a client's signed consent to receive traffic within Scope
+// at Address, which a sender presents with the CONSENTTOKEN method.
+type ConsentToken struct {
+	Address      string
+	Scope        ConsentScope
+	Key          []byte
+	Registration *ConsentRegistration `json:",omitempty"`
+	Signature    []byte
+}
+
+func registrationChallengeMessage(challenge string) []byte {
+	return []byte("sp3-register\n" + challenge)
+}
+
+// ProveConsentKey answers the server's registration challenge.
+func ProveConsentKey(key ed25519.PrivateKey, challenge string) *ConsentKeyProof {
+	return &ConsentKeyProof{
+		Key:       key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, registrationChallengeMessage(challenge)),
+	}
+}
+
+// Verify checks that the proof answers challenge.
+func (p *ConsentKeyProof) Verify(challenge string) error {
+	if len(p.Key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(p.Key), registrationChallengeMessage(challenge), p.Signature) {
+		return errors.New("Bad key proof")
+	}
+	return nil
+}
+
+func (r *ConsentRegistration) message() []byte {
+	return []byte("sp3-registration\n" + r.Address + "\n" + base64.StdEncoding.EncodeToString(r.Key) + "\n" + strconv.FormatInt(r.Expiry, 10))
+}
+
+// SignConsentRegistration registers key for address until expiry, signed
+// with the registrar's key.
+func SignConsentRegistration(registrar ed25519.PrivateKey, address net.IP, key []byte, expiry time.Time) *ConsentRegistration {
+	r := &ConsentRegistration{
+		Address:   address.String(),
+		Key:       key,
+		Expiry:    expiry.Unix(),
+		Registrar: registrar.Public().(ed25519.PublicKey),
+	}
+	r.Signature = ed25519.Sign(registrar, r.message())
+	return r
+}
+
+// Verify checks that the registration was signed by its Registrar, and hasn't
+// expired. Whether the registrar is trusted is up to the caller.
+func (r *ConsentRegistration) Verify() error {
+	if len(r.Registrar) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(r.Registrar), r.message(), r.Signature) {
+		return errors.New("Bad registration signature")
+	}
+	if time.Now().After(time.Unix(r.Expiry, 0)) {
+		return errors.New("Registration expired")
+	}
+	return nil
+}
+
+// message is the signed form of the token, with each field of the scope
+// written out in order, so that it doesn't depend on how the scope was
+// encoded on the way.
+func (t *ConsentToken) message() ([]byte, error) {
+	protocols := make([]string, len(t.Scope.Protocols))
+	for i, protocol := range t.Scope.Protocols {
+		protocols[i] = strconv.Itoa(protocol)
+	}
+	ports := make([]string, len(t.Scope.Ports))
+	for i, port := range t.Scope.Ports {
+		ports[i] = strconv.FormatUint(uint64(port), 10)
+	}
+	prefixes := make([]string, len(t.Scope.SourcePrefixes))
+	for i, prefix := range t.Scope.SourcePrefixes {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		prefixes[i] = network.String()
+	}
+	return []byte("sp3-consent\n" + t.Address + "\n" + base64.StdEncoding.EncodeToString(t.Key) + "\n" +
+		strings.Join(protocols, ",") + "\n" +
+		strings.Join(ports, ",") + "\n" +
+		strings.Join(prefixes, ",") + "\n" +
+		strconv.FormatUint(t.Scope.MaxPackets, 10) + "\n" +
+		strconv.FormatUint(t.Scope.MaxBytes, 10) + "\n" +
+		strconv.FormatInt(t.Scope.Expiry.Unix(), 10)), nil
+}
+
+// SignConsentToken consents to traffic within scope at address. The scope
+// must have an expiry. registration is the key's registration, if it isn't
+// configured at the servers the token is for.
+func SignConsentToken(key ed25519.PrivateKey, address net.IP, scope ConsentScope, registration *ConsentRegistration) (*ConsentToken, error) {
+	if scope.Expiry.IsZero() {
+		return nil, errors.New("Consent tokens must expire")
+	}
+	// Only whole seconds of the expiry are signed.
+	scope.Expiry = scope.Expiry.UTC().Truncate(time.Second)
+	t := &ConsentToken{
+		Address:      address.String(),
+		Scope:        scope,
+		Key:          key.Public().(ed25519.PublicKey),
+		Registration: registration,
+	}
+	message, err := t.message()
+	if err != nil {
+		return nil, err
+	}
+	t.Signature = ed25519.Sign(key, message)
+	return t, nil
+}
+
+// Verify checks that the token was signed by its Key. Whether the key may
+// consent for the address is up to the caller.
+func (t *ConsentToken) Verify() error {
+	message, err := t.message()
+	if err != nil {
+		return err
+	}
+	if len(t.Key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(t.Key), message, t.Signature) {
+		return errors.New("Bad consent token signature")
+	}
+	return nil
+}
+
+// Challenge is what the sender answers with to use the token: its signature,
+// in base64.
+func (t *ConsentToken) Challenge() string {
+	return base64.StdEncoding.EncodeToString(t.Signature)
+}
+
+// RegisterConsentKey registers key with an SP3 server, for the address the
+// server sees the connection come from.
+func RegisterConsentKey(sp3server url.URL, key ed25519.PrivateKey, dialer *websocket.Dialer) (*ConsentRegistration, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.Dial(sp3server.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	proof := &ConsentKeyProof{Key: key.Public().(ed25519.PublicKey)}
+	msg := ServerMessage{}
+	if err = conn.WriteJSON(&ClientMessage{Register: proof}); err != nil {
+		return nil, err
+	}
+	if err = conn.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Status != OKAY || msg.Challenge == "" {
+		return nil, registrationError(msg)
+	}
+	if err = conn.WriteJSON(&ClientMessage{Register: ProveConsentKey(key, msg.Challenge)}); err != nil {
+		return nil, err
+	}
+	msg = ServerMessage{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Status != OKAY || msg.Registration == nil {
+		return nil, registrationError(msg)
+	}
+	return msg.Registration, nil
+}
+
+func registrationError(msg ServerMessage) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	return errors.New("Server refused registration: " + strconv.Itoa(int(msg.Status)))
+}
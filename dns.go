@@ -0,0 +1,36 @@
+package sp3
+
+import (
+	"encoding/base32"
+	"strings"
+)
+
+// DNS reflection carries the challenge in the first label of a query name,
+// which resolvers echo in the question section of their answer. Names aren't
+// case sensitive, and resolvers may change their case, so the challenge is
+// encoded in base32.
+const dnsChallengePrefix = "sp3-"
+
+var dnsChallengeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// DNSChallengeName is the query name carrying token, under zone.
+func DNSChallengeName(token string, zone string) string {
+	name := dnsChallengePrefix + strings.ToLower(dnsChallengeEncoding.EncodeToString([]byte(token)))
+	if zone = strings.Trim(zone, "."); zone != "" {
+		name += "." + zone
+	}
+	return name
+}
+
+// DNSChallengeToken recovers the token from a name made by DNSChallengeName.
+func DNSChallengeToken(name string) (string, bool) {
+	label := strings.SplitN(name, ".", 2)[0]
+	if len(label) <= len(dnsChallengePrefix) || !strings.EqualFold(label[:len(dnsChallengePrefix)], dnsChallengePrefix) {
+		return "", false
+	}
+	token, err := dnsChallengeEncoding.DecodeString(strings.ToUpper(label[len(dnsChallengePrefix):]))
+	if err != nil || len(token) == 0 {
+		return "", false
+	}
+	return string(token), true
+}
@@ -0,0 +1,139 @@
+package sp3
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// When the sender isn't on the destination's host, the challenge a
+// consenting client is sent for it is relayed back through the server's
+// mailbox. The sender gives an X25519 PublicKey in its SenderHello, and the
+// server seals the challenge to that key before sending it to the client,
+// which posts it on from its own address. Only the sender can open it, so
+// nobody watching the client's connection or the mailbox learns the
+// challenge.
+
+// A MailboxPost is a client's relay of a sealed challenge to the sender with
+// Key.
+type MailboxPost struct {
+	Key    []byte // The sender's PublicKey
+	Sealed []byte
+}
+
+// NewMailboxKey makes a key for a sender to be relayed challenges with.
+func NewMailboxKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// mailboxCipher derives the cipher for a challenge sealed with an ephemeral
+// key, from the shared secret and both public keys. Each ephemeral key seals
+// one challenge, so a fixed nonce is safe.
+func mailboxCipher(shared []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("sp3-mailbox\n"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealChallenge encrypts challenge to recipient, an X25519 public key.
+func SealChallenge(recipient []byte, challenge string) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := NewMailboxKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	aead, err := mailboxCipher(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephemeralPublic, nonce, []byte(challenge), nil), nil
+}
+
+// OpenChallenge decrypts a challenge sealed to key.
+func OpenChallenge(key *ecdh.PrivateKey, sealed []byte) (string, error) {
+	size := len(key.PublicKey().Bytes())
+	if len(sealed) < size {
+		return "", errors.New("Sealed challenge too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[0:size])
+	if err != nil {
+		return "", err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return "", err
+	}
+	aead, err := mailboxCipher(shared, sealed[0:size], key.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	challenge, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(challenge), nil
+}
+
+// MailboxURL is where the server at sp3server, a websocket URL, takes posts
+// of sealed challenges.
+func MailboxURL(sp3server url.URL) *url.URL {
+	mailbox := sp3server.ResolveReference(&url.URL{Path: "mailbox"})
+	switch mailbox.Scheme {
+	case "ws":
+		mailbox.Scheme = "http"
+	case "wss":
+		mailbox.Scheme = "https"
+	}
+	return mailbox
+}
+
+// RelayChallenge posts the sealed challenge of msg, a message sent to a
+// consenting client for a sender with a PublicKey, to the server's mailbox at
+// sp3server.
+func RelayChallenge(sp3server url.URL, msg ServerMessage, client *http.Client) error {
+	if len(msg.PublicKey) == 0 || len(msg.Sealed) == 0 {
+		return errors.New("Challenge isn't for a relayed sender")
+	}
+	body, err := json.Marshal(&MailboxPost{Key: msg.PublicKey, Sealed: msg.Sealed})
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(MailboxURL(sp3server).String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New("Mailbox refused challenge: " + resp.Status + " " + string(bytes.TrimSpace(reason)))
+	}
+	return nil
+}
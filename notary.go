@@ -0,0 +1,62 @@
+package sp3
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// A NotaryAttestation is a web notary's signed statement that it got a
+// request from IP at Timestamp, for use with the SP3 server named Server.
+// The sender forwards it as the AuthenticationOptions of the WEBNOTARY method.
+type NotaryAttestation struct {
+	Server    string // Host name of the SP3 server the attestation is for
+	IP        string
+	Timestamp int64  // Unix seconds
+	Key       []byte // The notary's ed25519 public key
+	Signature []byte
+}
+
+// message is what the notary signs.
+func (a *NotaryAttestation) message() []byte {
+	return []byte("sp3-notary\n" + a.Server + "\n" + a.IP + "\n" + strconv.FormatInt(a.Timestamp, 10))
+}
+
+// SignNotaryAttestation attests that ip was seen at time at, for the SP3
+// server named server.
+func SignNotaryAttestation(key ed25519.PrivateKey, server string, ip net.IP, at time.Time) *NotaryAttestation {
+	a := &NotaryAttestation{
+		Server:    server,
+		IP:        ip.String(),
+		Timestamp: at.Unix(),
+		Key:       key.Public().(ed25519.PublicKey),
+	}
+	a.Signature = ed25519.Sign(key, a.message())
+	return a
+}
+
+// Verify checks that the attestation was signed by its Key. Whether that
+// notary is trusted is up to the caller.
+func (a *NotaryAttestation) Verify() error {
+	if len(a.Key) != ed25519.PublicKeySize || net.ParseIP(a.IP) == nil {
+		return errors.New("Malformed attestation")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(a.Key), a.message(), a.Signature) {
+		return errors.New("Bad attestation signature")
+	}
+	return nil
+}
+
+// Time is when the notary saw the request.
+func (a *NotaryAttestation) Time() time.Time {
+	return time.Unix(a.Timestamp, 0)
+}
+
+// Challenge is what the sender answers with to use the attestation: its
+// signature, in base64.
+func (a *NotaryAttestation) Challenge() string {
+	return base64.StdEncoding.EncodeToString(a.Signature)
+}
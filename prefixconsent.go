@@ -0,0 +1,55 @@
+package sp3
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PrefixConsent is a network operator's consent to spoofed traffic to every
+// address in Prefix. It is published as JSON, in a TXT record at the name
+// given by PrefixConsentName. A host can also publish consent for its own
+// address alone, as a /32 or /128 prefix, at
+// https://<host>/.well-known/sp3-consent. The scope must have an expiry.
+type PrefixConsent struct {
+	Prefix string
+	Scope  ConsentScope
+}
+
+// PrefixConsentOptions are the AuthenticationOptions of the PREFIXCONSENT
+// method. The record is looked up in DNS, unless Host is given.
+type PrefixConsentOptions struct {
+	Prefix string
+	Host   string `json:",omitempty"` // The host at the prefix's one address, reached on port 443
+}
+
+// PrefixConsentPath is where hosts publish consent for their prefix.
+const PrefixConsentPath = "/.well-known/sp3-consent"
+
+// PrefixConsentName is the DNS name of the consent record for prefix, under
+// the reverse zone of its network address. Reverse zones are delegated on
+// octet (or for IPv6, nibble) boundaries, so the zone is the longest one
+// covering the whole prefix.
+func PrefixConsentName(prefix *net.IPNet) (string, error) {
+	bits, size := prefix.Mask.Size()
+	labels := []string{}
+	if ip := prefix.IP.To4(); ip != nil && size == 32 {
+		for i := bits/8 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+		labels = append(labels, "in-addr", "arpa")
+	} else if ip := prefix.IP.To16(); ip != nil && size == 128 {
+		for i := bits/4 - 1; i >= 0; i-- {
+			nibble := ip[i/2] >> 4
+			if i%2 == 1 {
+				nibble = ip[i/2] & 0xf
+			}
+			labels = append(labels, strconv.FormatInt(int64(nibble), 16))
+		}
+		labels = append(labels, "ip6", "arpa")
+	} else {
+		return "", errors.New("Not an IP prefix")
+	}
+	return "_sp3-consent." + strings.Join(labels, "."), nil
+}
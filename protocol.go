@@ -1,20 +1,32 @@
 package sp3
 
+import (
+	"strconv"
+	"time"
+)
+
 type AuthenticationMethod int
 
 const (
 	WEBSOCKET AuthenticationMethod = iota
 	STUNINJECTION
 	PATHREFLECTION
+	DNSREFLECTION
+	WEBNOTARY
+	CONSENTTOKEN
+	PREFIXCONSENT
 )
 
 type Status int
 
 const (
-	OKAY         Status = iota
-	UNAUTHORIZED        // Sender isn't authorized to send to that destination
-	UNSUPPORTED         // Server doesn't support the requested AuthenticationMethod
-	INVALID             // Server failed to parse the message
+	OKAY           Status = iota
+	UNAUTHORIZED          // Sender isn't authorized to send to that destination
+	UNSUPPORTED           // Server doesn't support the requested AuthenticationMethod
+	INVALID               // Server failed to parse the message
+	REVOKED               // The destination withdrew its consent, or it expired
+	REAUTHENTICATE        // Sender must repeat its SenderHello and SenderAuthorization
+	SUSPENDED             // Sender didn't reauthenticate in time, and packets are dropped
 )
 
 type State int
@@ -23,18 +35,61 @@ const (
 	SENDERHELLO State = iota // Waiting for client Hello message.
 	HELLORECEIVED
 	AUTHORIZED // Acceptable ClientAuhtorization received.
+	LAPSED     // Reauthentication is overdue, and packets are dropped.
 )
 
 type SenderHello struct {
 	DestinationAddress    string
 	AuthenticationMethod  AuthenticationMethod
 	AuthenticationOptions []byte
+	PublicKey             []byte        `json:",omitempty"` // X25519 key for WEBSOCKET challenges relayed through the mailbox
+	Purpose               string        `json:",omitempty"` // Why the sender wants to send, shown to clients which approve senders
+	Limits                *ConsentScope `json:",omitempty"` // Limits the sender asks to be held to, if approved
 }
 
 type ServerMessage struct {
-	Status    Status
-	Challenge string
-	Sent      []byte
+	Status       Status
+	Challenge    string
+	Sent         []byte
+	Error        *Error               `json:",omitempty"`
+	Registration *ConsentRegistration `json:",omitempty"` // Answers a ConsentKeyProof
+	PublicKey    []byte               `json:",omitempty"` // Key of the sender a challenge is to be relayed to
+	Sealed       []byte               `json:",omitempty"` // A challenge relayed through the mailbox
+	Request      *SenderRequest       `json:",omitempty"` // A sender awaiting the client's approval
+	Traffic      *TrafficNotice       `json:",omitempty"` // What has been sent under the client's consent
+}
+
+type ErrorCode string
+
+const (
+	MALFORMEDOPTIONS    ErrorCode = "MALFORMED_OPTIONS"    // AuthenticationOptions couldn't be parsed
+	DESTINATIONMISMATCH ErrorCode = "DESTINATION_MISMATCH" // Options are for a different address than the destination
+	UNROUTABLEADDRESS   ErrorCode = "UNROUTABLE_ADDRESS"   // An address isn't routable unicast
+	BADPORT             ErrorCode = "BAD_PORT"             // A port isn't acceptable for the method
+	UNTRUSTEDREFLECTOR  ErrorCode = "UNTRUSTED_REFLECTOR"  // The reflector isn't one the server uses
+	CHALLENGEPENDING    ErrorCode = "CHALLENGE_PENDING"    // A challenge is already outstanding for the connection
+	CHALLENGEEXPIRED    ErrorCode = "CHALLENGE_EXPIRED"    // The challenge wasn't answered in time
+	CHALLENGEUNKNOWN    ErrorCode = "CHALLENGE_UNKNOWN"    // The challenge wasn't issued, or was already used
+	RATELIMITED         ErrorCode = "RATE_LIMITED"         // Too many challenges were requested, see RetryAfter
+	UNTRUSTEDNOTARY     ErrorCode = "UNTRUSTED_NOTARY"     // The attestation isn't signed by a notary the server trusts
+	BADATTESTATION      ErrorCode = "BAD_ATTESTATION"      // The signature of an attestation or token doesn't verify
+	UNREGISTEREDKEY     ErrorCode = "UNREGISTERED_KEY"     // The key of a consent token isn't registered for its address
+	NOCONSENTRECORD     ErrorCode = "NO_CONSENT_RECORD"    // No consent is published for the prefix
+	SENDERDENIED        ErrorCode = "SENDER_DENIED"        // The client didn't approve the sender
+)
+
+// An Error explains why the server rejected a message.
+type Error struct {
+	Code       ErrorCode
+	Message    string
+	RetryAfter int `json:",omitempty"` // Seconds to wait before trying again
+}
+
+func (e *Error) Error() string {
+	if e.RetryAfter > 0 {
+		return string(e.Code) + ": " + e.Message + " (retry after " + strconv.Itoa(e.RetryAfter) + "s)"
+	}
+	return string(e.Code) + ": " + e.Message
 }
 
 type SenderAuthorization struct {
@@ -45,3 +100,75 @@ type SenderAuthorization struct {
 type SenderMessage struct {
 	Packet []byte
 }
+
+// ConsentScope limits the spoofed traffic a client agrees to receive. Empty
+// or zero fields place no limit.
+type ConsentScope struct {
+	Protocols      []int     // IP protocol numbers, e.g. 6 for TCP, 17 for UDP
+	Ports          []uint16  // Destination TCP and UDP ports
+	SourcePrefixes []string  // CIDR prefixes packets may claim to come from
+	MaxPackets     uint64    // Total packets, across all senders
+	MaxBytes       uint64    // Total bytes, across all senders
+	Expiry         time.Time // When consent ends, otherwise on disconnection
+}
+
+// ClientHello is sent by a client to consent to receiving spoofed packets
+// at the address it connected from. With Approve set, each sender is sent to
+// the client as a SenderRequest, and only challenged once the client accepts.
+type ClientHello struct {
+	Scope   ConsentScope
+	Approve bool `json:",omitempty"`
+}
+
+// SenderRequest describes a sender to a client which approves senders.
+type SenderRequest struct {
+	ID      string
+	Sender  string // Address of the sender
+	Method  AuthenticationMethod
+	Purpose string        `json:",omitempty"`
+	Limits  *ConsentScope `json:",omitempty"`
+}
+
+// TrafficNotice is sent periodically to a consenting client, about the
+// traffic sent under its consent. Packets and bytes are those sent, by all
+// senders, and Dropped the packets which weren't sent because they were
+// outside the consent.
+type TrafficNotice struct {
+	Packets uint64
+	Bytes   uint64
+	Dropped uint64
+	Senders []SenderTraffic // Those currently authorized
+}
+
+// SenderTraffic is the traffic of one authorized sender. SourcePrefixes are
+// the /24 (or for IPv6, /48) prefixes its packets claimed to come from.
+type SenderTraffic struct {
+	Session        string // The server's ID for the sender's connection
+	Sender         string // Address of the sender
+	Method         AuthenticationMethod
+	Packets        uint64
+	Bytes          uint64
+	Dropped        uint64
+	SourcePrefixes []string
+}
+
+// SenderDecision answers the SenderRequest with ID. An accepted sender is
+// held to Limits if they are given, and otherwise to the limits it asked for,
+// within the client's consent either way. Reason explains a denial.
+type SenderDecision struct {
+	ID     string
+	Accept bool
+	Limits *ConsentScope `json:",omitempty"`
+	Reason string        `json:",omitempty"`
+}
+
+// ClientMessage is the envelope for messages from a consenting client.
+// Revoke withdraws consent given in an earlier ClientHello. Register
+// registers a key for signing consent tokens. Decision answers a
+// SenderRequest.
+type ClientMessage struct {
+	Hello    *ClientHello     `json:",omitempty"`
+	Revoke   bool             `json:",omitempty"`
+	Register *ConsentKeyProof `json:",omitempty"`
+	Decision *SenderDecision  `json:",omitempty"`
+}
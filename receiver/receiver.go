@@ -0,0 +1,344 @@
+/**
+ * Package receiver is a consenting client for SP^3, for programs which want
+ * to receive spoofed packets at their own address. It keeps a websocket
+ * connection to the server open, declaring the scope of its consent, and
+ * passes on the requests of senders which arrive through it.
+ */
+package receiver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+// Reconnection is attempted after minBackoff, doubling up to maxBackoff while
+// the server can't be reached.
+const minBackoff = 500 * time.Millisecond
+const maxBackoff = time.Minute
+
+// Undelivered requests and revocations are dropped beyond this many.
+const queueSize = 16
+
+// A Request is a sender asking to send to the receiver, with the challenge
+// that authorizes it.
+type Request struct {
+	Challenge string
+	// Senders on another host wait for their challenge to be relayed to
+	// them. It comes sealed to their PublicKey instead of as Challenge.
+	PublicKey []byte
+	Sealed    []byte
+
+	receiver *Receiver
+}
+
+// Relay posts the sealed challenge to the server's mailbox, for the sender
+// to pick up.
+func (r *Request) Relay() error {
+	return sp3.RelayChallenge(r.receiver.server, sp3.ServerMessage{
+		Status:    sp3.OKAY,
+		PublicKey: r.PublicKey,
+		Sealed:    r.Sealed,
+	}, r.receiver.Client)
+}
+
+// An Approval is a sender asking the receiver's approval, before it is
+// challenged.
+type Approval struct {
+	sp3.SenderRequest
+
+	receiver *Receiver
+}
+
+// Accept approves the sender, within the limits it asked for.
+func (a *Approval) Accept() error {
+	return a.receiver.decide(&sp3.SenderDecision{ID: a.ID, Accept: true})
+}
+
+// AcceptWithin approves the sender, within limits instead.
+func (a *Approval) AcceptWithin(limits sp3.ConsentScope) error {
+	return a.receiver.decide(&sp3.SenderDecision{ID: a.ID, Accept: true, Limits: &limits})
+}
+
+// Deny turns the sender away, telling it reason.
+func (a *Approval) Deny(reason string) error {
+	return a.receiver.decide(&sp3.SenderDecision{ID: a.ID, Reason: reason})
+}
+
+// A Receiver consents to spoofed packets at the address it connects from,
+// reconnecting to the server when the connection drops.
+type Receiver struct {
+	// Requests has each sender which asks to send within the consent.
+	Requests <-chan *Request
+	// Approvals has each sender waiting to be approved, for receivers
+	// started with ListenApproving.
+	Approvals <-chan *Approval
+	// Traffic has the server's periodic notices of what is sent under the
+	// consent.
+	Traffic <-chan *sp3.TrafficNotice
+	// Revocations has the reason each time consent ends, whether the server
+	// ended it, or the connection was lost. Consent is given again on
+	// reconnection, but not after the server ends it.
+	Revocations <-chan error
+	// Client relays challenges, http.DefaultClient if nil.
+	Client *http.Client
+
+	server      url.URL
+	dialer      *websocket.Dialer
+	requests    chan *Request
+	approvals   chan *Approval
+	traffic     chan *sp3.TrafficNotice
+	revocations chan error
+
+	lock      sync.Mutex
+	conn      *websocket.Conn
+	scope     sp3.ConsentScope
+	approve   bool
+	consented bool
+	revoking  int // Acknowledgements due for our own revocations
+	closed    bool
+	done      chan struct{}
+}
+
+var errClosed = errors.New("Receiver closed")
+
+// Listen connects to the websocket of sp3server and consents to receive
+// packets within scope.
+func Listen(sp3server url.URL, scope sp3.ConsentScope, dialer *websocket.Dialer) (*Receiver, error) {
+	return listen(sp3server, sp3.ClientHello{Scope: scope}, dialer)
+}
+
+// ListenApproving consents like Listen, but has each sender approved through
+// Approvals before it is challenged.
+func ListenApproving(sp3server url.URL, scope sp3.ConsentScope, dialer *websocket.Dialer) (*Receiver, error) {
+	return listen(sp3server, sp3.ClientHello{Scope: scope, Approve: true}, dialer)
+}
+
+func listen(sp3server url.URL, hello sp3.ClientHello, dialer *websocket.Dialer) (*Receiver, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	r := &Receiver{
+		server:      sp3server,
+		dialer:      dialer,
+		requests:    make(chan *Request, queueSize),
+		approvals:   make(chan *Approval, queueSize),
+		traffic:     make(chan *sp3.TrafficNotice, queueSize),
+		revocations: make(chan error, queueSize),
+		scope:       hello.Scope,
+		approve:     hello.Approve,
+		consented:   true,
+		done:        make(chan struct{}),
+	}
+	r.Requests = r.requests
+	r.Approvals = r.approvals
+	r.Traffic = r.traffic
+	r.Revocations = r.revocations
+	conn, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	go r.run(conn)
+	return r, nil
+}
+
+// connect opens a connection, and consents on it if consent is wanted.
+func (r *Receiver) connect() (*websocket.Conn, error) {
+	conn, _, err := r.dialer.Dial(r.server.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		conn.Close()
+		return nil, errClosed
+	}
+	r.conn = conn
+	r.revoking = 0
+	if r.consented {
+		if err = conn.WriteJSON(&sp3.ClientMessage{Hello: r.hello()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// run reads from each connection in turn until the receiver is closed.
+func (r *Receiver) run(conn *websocket.Conn) {
+	defer close(r.requests)
+	defer close(r.approvals)
+	defer close(r.traffic)
+	defer close(r.revocations)
+	for {
+		err := r.read(conn)
+		conn.Close()
+		if r.isClosed() {
+			return
+		}
+		r.lock.Lock()
+		consented := r.consented
+		r.lock.Unlock()
+		if consented {
+			r.revoked(errors.New("Connection lost: " + err.Error()))
+		}
+
+		backoff := minBackoff
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-r.done:
+				return
+			}
+			if conn, err = r.connect(); err == nil {
+				break
+			} else if err == errClosed {
+				return
+			}
+			log.Printf("Couldn't reconnect to %v: %v", r.server.String(), err)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// read handles messages from conn until it fails.
+func (r *Receiver) read(conn *websocket.Conn) error {
+	for {
+		msg := sp3.ServerMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		switch {
+		case msg.Status == sp3.OKAY && (msg.Challenge != "" || len(msg.Sealed) > 0):
+			select {
+			case r.requests <- &Request{Challenge: msg.Challenge, PublicKey: msg.PublicKey, Sealed: msg.Sealed, receiver: r}:
+			default:
+				log.Printf("Request dropped, none are being read.")
+			}
+		case msg.Status == sp3.OKAY && msg.Request != nil:
+			select {
+			case r.approvals <- &Approval{SenderRequest: *msg.Request, receiver: r}:
+			default:
+				// The sender is denied when the server gives up waiting.
+				log.Printf("Approval dropped, none are being read.")
+			}
+		case msg.Status == sp3.OKAY && msg.Traffic != nil:
+			// Notices are dropped if nobody reads them.
+			select {
+			case r.traffic <- msg.Traffic:
+			default:
+			}
+		case msg.Status == sp3.REVOKED:
+			r.lock.Lock()
+			ours := r.revoking > 0
+			if ours {
+				r.revoking--
+			} else {
+				r.consented = false
+			}
+			r.lock.Unlock()
+			if !ours {
+				r.revoked(errors.New("Consent ended"))
+			}
+		case msg.Status != sp3.OKAY:
+			err := errors.New("Server refused consent: " + strconv.Itoa(int(msg.Status)))
+			if msg.Error != nil {
+				err = msg.Error
+			}
+			r.revoked(err)
+		}
+	}
+}
+
+func (r *Receiver) revoked(err error) {
+	select {
+	case r.revocations <- err:
+	default:
+		log.Printf("Revocation dropped, none are being read: %v", err)
+	}
+}
+
+func (r *Receiver) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+func (r *Receiver) hello() *sp3.ClientHello {
+	return &sp3.ClientHello{Scope: r.scope, Approve: r.approve}
+}
+
+func (r *Receiver) decide(decision *sp3.SenderDecision) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.write(&sp3.ClientMessage{Decision: decision})
+}
+
+// write sends msg on the current connection. Messages are lost if the
+// connection is down, but consent is given again when it comes back.
+func (r *Receiver) write(msg *sp3.ClientMessage) error {
+	if r.closed {
+		return errClosed
+	}
+	return r.conn.WriteJSON(msg)
+}
+
+// Consent replaces the scope of the receiver's consent, giving it again if
+// it had ended.
+func (r *Receiver) Consent(scope sp3.ConsentScope) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// The server takes one consent at a time.
+	if r.consented {
+		if err := r.revoke(); err != nil {
+			return err
+		}
+	}
+	r.scope = scope
+	r.consented = true
+	return r.write(&sp3.ClientMessage{Hello: r.hello()})
+}
+
+// Revoke withdraws consent, stopping the senders relying on it, while
+// staying connected.
+func (r *Receiver) Revoke() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.consented {
+		return nil
+	}
+	r.consented = false
+	return r.revoke()
+}
+
+// revoke asks the server to end consent, which it acknowledges.
+func (r *Receiver) revoke() error {
+	if err := r.write(&sp3.ClientMessage{Revoke: true}); err != nil {
+		return err
+	}
+	r.revoking++
+	return nil
+}
+
+// Close disconnects, ending consent. The Requests and Revocations channels
+// are closed once the connection is.
+func (r *Receiver) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	return r.conn.Close()
+}
@@ -0,0 +1,143 @@
+package receiver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willscott/sp3"
+	"github.com/willscott/sp3/server/lib"
+)
+
+func startServer() (*httptest.Server, url.URL) {
+	s := server.NewServer(server.Config{PathReflectionFile: "../server/pathreflection.json"}, server.NewMemoryWriter(1))
+	mux := http.NewServeMux()
+	mux.Handle("/sp3", server.SocketHandler(s))
+	mux.Handle("/mailbox", server.MailboxHandler(s))
+	web := httptest.NewServer(mux)
+	return web, url.URL{Scheme: "ws", Host: strings.TrimPrefix(web.URL, "http://"), Path: "/sp3"}
+}
+
+// relaySender dials a sender on another connection, relaying its challenge
+// through r.
+func relaySender(t *testing.T, sp3url url.URL, r *Receiver) {
+	dialed := make(chan error)
+	go func() {
+		conn, err := sp3.Dial(sp3url, net.IP{127, 0, 0, 1}, sp3.RelayedAuth{}, nil)
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	select {
+	case request := <-r.Requests:
+		if err := request.Relay(); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No request from the sender")
+	}
+	if err := <-dialed; err != nil {
+		t.Fatal("Relayed sender not authorized", err)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	web, sp3url := startServer()
+	defer web.Close()
+
+	r, err := Listen(sp3url, sp3.ConsentScope{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	time.Sleep(50 * time.Millisecond)
+	relaySender(t, sp3url, r)
+
+	// Consent is given again after the connection drops.
+	r.lock.Lock()
+	r.conn.Close()
+	r.lock.Unlock()
+	select {
+	case err := <-r.Revocations:
+		if !strings.HasPrefix(err.Error(), "Connection lost") {
+			t.Fatal("Unexpected revocation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lost connection not reported")
+	}
+	time.Sleep(minBackoff + 100*time.Millisecond)
+	relaySender(t, sp3url, r)
+
+	// Revoking our own consent isn't reported, but consent the server ends is.
+	if err := r.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Consent(sp3.ConsentScope{Expiry: time.Now().Add(100 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-r.Revocations:
+		if err.Error() != "Consent ended" {
+			t.Fatal("Unexpected revocation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expiry not reported")
+	}
+
+	r.Close()
+	if _, ok := <-r.Requests; ok {
+		t.Fatal("Requests still open after closing")
+	}
+}
+
+func TestApprovingReceiver(t *testing.T) {
+	web, sp3url := startServer()
+	defer web.Close()
+
+	r, err := ListenApproving(sp3url, sp3.ConsentScope{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	dialed := make(chan error)
+	dial := func() {
+		conn, err := sp3.Dial(sp3url, net.IP{127, 0, 0, 1}, sp3.RelayedAuth{Purpose: "Testing"}, nil)
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}
+	approval := func() *Approval {
+		select {
+		case approval := <-r.Approvals:
+			return approval
+		case <-time.After(2 * time.Second):
+			t.Fatal("No approval requested")
+		}
+		return nil
+	}
+
+	go dial()
+	if a := approval(); a.Purpose != "Testing" {
+		t.Fatal("Purpose not given", a.SenderRequest)
+	} else {
+		a.Deny("Busy")
+	}
+	if err := <-dialed; err == nil || !strings.Contains(err.Error(), "Busy") {
+		t.Fatal("Denied sender not told why", err)
+	}
+
+	go dial()
+	approval().Accept()
+	(<-r.Requests).Relay()
+	if err := <-dialed; err != nil {
+		t.Fatal("Approved sender not authorized", err)
+	}
+}
@@ -0,0 +1,251 @@
+package sp3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TokenPlaceholder marks where the challenge goes in a ReflectorProfile's
+// path and headers.
+const TokenPlaceholder = "{token}"
+
+// ReflectorProtocol is the application protocol a path reflector speaks.
+type ReflectorProtocol string
+
+const (
+	HTTP ReflectorProtocol = "http"
+	SMTP ReflectorProtocol = "smtp" // The token is echoed in the reply to EHLO
+	FTP  ReflectorProtocol = "ftp"  // The token is echoed in the reply to USER
+)
+
+/**
+ * A ReflectorProfile describes how to make a path reflector echo a challenge
+ * back to the client: the request the server injects, and where the client
+ * finds the challenge in the response. Empty fields take the defaults of a
+ * web server which echoes the path of a GET in its 404 page.
+ *
+ * SMTP and FTP reflectors are sent a single command, whose verb is the
+ * Method and whose argument is the Path. Host, Version and Headers only
+ * apply to HTTP.
+ */
+type ReflectorProfile struct {
+	Protocol   ReflectorProtocol `json:",omitempty"` // http if unset
+	Host       string            // Host header of the request
+	Port       uint16            // TCP port of the reflector, the protocol's own if unset
+	Method     string            // Request method or command, GET, EHLO or USER if unset
+	Path       string            // Request path or command argument, "/sp3.{token}/" or "sp3.{token}" if unset
+	Version    string            // HTTP version, HTTP/1.0 if unset; HTTP/1.1 needs a Host
+	Headers    map[string]string `json:",omitempty"` // Extra headers, which may include {token}
+	Extraction string            // Regular expression whose first group matches the token in the response
+}
+
+const (
+	defaultReflectorPath       = "/sp3." + TokenPlaceholder + "/"
+	defaultReflectorArgument   = "sp3." + TokenPlaceholder
+	defaultReflectorExtraction = `sp3\.([A-Za-z0-9]+)`
+)
+
+var defaultReflectorPorts = map[ReflectorProtocol]uint16{HTTP: 80, SMTP: 25, FTP: 21}
+var defaultReflectorCommands = map[ReflectorProtocol]string{HTTP: "GET", SMTP: "EHLO", FTP: "USER"}
+
+// A profile may also be given as just the host name, for the defaults.
+func (p *ReflectorProfile) UnmarshalJSON(data []byte) error {
+	var host string
+	if err := json.Unmarshal(data, &host); err == nil {
+		*p = ReflectorProfile{Host: host}
+		return nil
+	}
+	type profile ReflectorProfile
+	return json.Unmarshal(data, (*profile)(p))
+}
+
+// Check finds problems with the profile, which would stop it from working.
+func (p ReflectorProfile) Check() error {
+	if _, ok := defaultReflectorPorts[p.protocol()]; !ok {
+		return errors.New("Unknown protocol " + string(p.Protocol))
+	}
+	if p.protocol() != HTTP {
+		return p.checkCommand()
+	}
+	path := p.Path
+	if path == "" {
+		path = defaultReflectorPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		return errors.New("Path must start with /")
+	}
+	inHeader := false
+	for _, value := range p.Headers {
+		inHeader = inHeader || strings.Contains(value, TokenPlaceholder)
+	}
+	if !strings.Contains(path, TokenPlaceholder) && !inHeader {
+		return errors.New("Request doesn't include " + TokenPlaceholder)
+	}
+	for _, field := range []string{p.Host, p.Method, path, p.Version} {
+		if strings.ContainsAny(field, "\r\n") {
+			return errors.New("Line break in request")
+		}
+	}
+	hasHost := p.Host != ""
+	for key, value := range p.Headers {
+		if strings.ContainsAny(key+value, "\r\n") || strings.Contains(key, ":") {
+			return errors.New("Bad header " + key)
+		}
+		hasHost = hasHost || strings.EqualFold(key, "Host")
+	}
+	if p.Version == "HTTP/1.1" && !hasHost {
+		return errors.New("HTTP/1.1 requests need a Host")
+	}
+	return p.checkExtraction()
+}
+
+// checkCommand is Check for the line based protocols.
+func (p ReflectorProfile) checkCommand() error {
+	if p.Host != "" || p.Version != "" || len(p.Headers) > 0 {
+		return errors.New("Host, Version and Headers only apply to http")
+	}
+	command, argument := p.command()
+	if strings.ContainsAny(command, " \r\n") || strings.ContainsAny(argument, "\r\n") {
+		return errors.New("Line break in request")
+	}
+	if !strings.Contains(argument, TokenPlaceholder) {
+		return errors.New("Request doesn't include " + TokenPlaceholder)
+	}
+	return p.checkExtraction()
+}
+
+func (p ReflectorProfile) checkExtraction() error {
+	re, err := p.extraction()
+	if err != nil {
+		return err
+	}
+	if re.NumSubexp() < 1 {
+		return errors.New("Extraction has no group for the token")
+	}
+	return nil
+}
+
+func (p ReflectorProfile) protocol() ReflectorProtocol {
+	if p.Protocol == "" {
+		return HTTP
+	}
+	return p.Protocol
+}
+
+// command is the verb and argument of the request, with their defaults.
+func (p ReflectorProfile) command() (string, string) {
+	command, argument := p.Method, p.Path
+	if command == "" {
+		command = defaultReflectorCommands[p.protocol()]
+	}
+	if argument == "" {
+		if p.protocol() == HTTP {
+			argument = defaultReflectorPath
+		} else {
+			argument = defaultReflectorArgument
+		}
+	}
+	return command, argument
+}
+
+// ServerPort is the port the reflector is reached on.
+func (p ReflectorProfile) ServerPort() uint16 {
+	if p.Port == 0 {
+		return defaultReflectorPorts[p.protocol()]
+	}
+	return p.Port
+}
+
+// Greeting is true for protocols where the reflector speaks first, so its
+// greeting comes before the response to the request. The request is only
+// sent once all of the greeting has arrived.
+func (p ReflectorProfile) Greeting() bool {
+	return p.protocol() == SMTP || p.protocol() == FTP
+}
+
+// GreetingEnd is the length of the greeting at the start of response, once
+// all of it has arrived, or 0 until then. SMTP and FTP greetings may run over
+// several lines, the last of which has a space after its reply code.
+func (p ReflectorProfile) GreetingEnd(response []byte) int {
+	start := 0
+	for {
+		end := bytes.IndexByte(response[start:], '\n')
+		if end < 0 {
+			return 0
+		}
+		line := response[start : start+end]
+		start += end + 1
+		if len(line) < 4 || line[3] == ' ' || line[3] == '\r' {
+			return start
+		}
+	}
+}
+
+// Request builds the request carrying token.
+func (p ReflectorProfile) Request(token string) []byte {
+	fill := func(s string) string {
+		return strings.Replace(s, TokenPlaceholder, token, -1)
+	}
+	method, path := p.command()
+	if p.protocol() != HTTP {
+		return []byte(method + " " + fill(path) + "\r\n")
+	}
+	version := p.Version
+	if version == "" {
+		version = "HTTP/1.0"
+	}
+
+	request := method + " " + fill(path) + " " + version + "\r\n"
+	if p.Host != "" {
+		request += "Host: " + p.Host + "\r\n"
+	}
+	keys := make([]string, 0, len(p.Headers))
+	for key := range p.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		request += key + ": " + fill(p.Headers[key]) + "\r\n"
+	}
+	if _, ok := p.Headers["Connection"]; !ok && version == "HTTP/1.1" {
+		request += "Connection: close\r\n"
+	}
+	return []byte(request + "\r\n")
+}
+
+// FindToken extracts the token from the response of the reflector.
+func (p ReflectorProfile) FindToken(response []byte) (string, bool) {
+	re, err := p.extraction()
+	if err != nil {
+		return "", false
+	}
+	match := re.FindSubmatch(response)
+	if len(match) < 2 || len(match[1]) == 0 {
+		return "", false
+	}
+	return string(match[1]), true
+}
+
+// Extractions are compiled once, since FindToken is called for each packet.
+var extractions sync.Map
+
+func (p ReflectorProfile) extraction() (*regexp.Regexp, error) {
+	expression := p.Extraction
+	if expression == "" {
+		expression = defaultReflectorExtraction
+	}
+	if re, ok := extractions.Load(expression); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	extractions.Store(expression, re)
+	return re, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/willscott/sp3"
+)
+
+// How long a client has to approve a sender.
+const approvalTimeout = 30 * time.Second
+
+// Approvals are the sender requests waiting on a client's decision.
+type Approvals struct {
+	pending map[string]approval
+	sync.Mutex
+}
+
+type approval struct {
+	client   *Session
+	decision chan sp3.SenderDecision
+}
+
+func NewApprovals() *Approvals {
+	return &Approvals{pending: make(map[string]approval)}
+}
+
+// Decide passes on the decision of client about one of its requests.
+func (a *Approvals) Decide(client *Session, decision sp3.SenderDecision) {
+	a.Lock()
+	pending, ok := a.pending[decision.ID]
+	if ok && pending.client == client {
+		delete(a.pending, decision.ID)
+	}
+	a.Unlock()
+	if !ok || pending.client != client {
+		log.Printf("Decision from %v on unknown request %v.", client.RemoteAddr, decision.ID)
+		return
+	}
+	pending.decision <- decision
+}
+
+// approve asks the client of grant to approve sender, and returns the grant
+// the sender is held to if it does.
+func (s *Server) approve(grant *Grant, sender string, hello sp3.SenderHello) (*Grant, error) {
+	request := &sp3.SenderRequest{
+		ID:      uuid.New(),
+		Sender:  sender,
+		Method:  hello.AuthenticationMethod,
+		Purpose: hello.Purpose,
+		Limits:  hello.Limits,
+	}
+	pending := approval{grant.Client, make(chan sp3.SenderDecision, 1)}
+	s.approvals.Lock()
+	s.approvals.pending[request.ID] = pending
+	s.approvals.Unlock()
+	defer func() {
+		s.approvals.Lock()
+		delete(s.approvals.pending, request.ID)
+		s.approvals.Unlock()
+	}()
+
+	if err := grant.Client.Send(sp3.ServerMessage{Status: sp3.OKAY, Request: request}); err != nil {
+		return nil, err
+	}
+	var decision sp3.SenderDecision
+	select {
+	case decision = <-pending.decision:
+	case <-grant.Done():
+		return nil, &sp3.Error{Code: sp3.SENDERDENIED, Message: "Consent ended before the sender was approved"}
+	case <-time.After(approvalTimeout):
+		return nil, &sp3.Error{Code: sp3.SENDERDENIED, Message: "The client didn't answer"}
+	}
+	if !decision.Accept {
+		reason := decision.Reason
+		if reason == "" {
+			reason = "The client denied the sender"
+		}
+		return nil, &sp3.Error{Code: sp3.SENDERDENIED, Message: reason}
+	}
+
+	limits := hello.Limits
+	if decision.Limits != nil {
+		limits = decision.Limits
+	}
+	if limits == nil {
+		return grant, nil
+	}
+	narrowed, err := grant.Narrow(*limits)
+	if err != nil {
+		return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+	}
+	return narrowed, nil
+}
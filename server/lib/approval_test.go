@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+func TestSenderApproval(t *testing.T) {
+	writer := NewMemoryWriter(5)
+	server := NewServer(Config{}, writer)
+	web := httptest.NewServer(SocketHandler(server))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{Approve: true}})
+	time.Sleep(50 * time.Millisecond)
+
+	// request has a sender ask for approval, and returns what the client is
+	// asked.
+	request := func() (*websocket.Conn, *sp3.SenderRequest) {
+		sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.WriteJSON(sp3.SenderHello{
+			DestinationAddress: "127.0.0.1",
+			Purpose:            "Hole punching",
+			Limits:             &sp3.ConsentScope{MaxPackets: 10},
+		})
+		msg := sp3.ServerMessage{}
+		if err := client.ReadJSON(&msg); err != nil || msg.Request == nil || msg.Challenge != "" {
+			t.Fatal("Client not asked to approve the sender", msg, err)
+		}
+		return sender, msg.Request
+	}
+
+	sender, req := request()
+	if req.Sender != "127.0.0.1" || req.Method != sp3.WEBSOCKET || req.Purpose != "Hole punching" || req.Limits.MaxPackets != 10 {
+		t.Fatal("Sender not described", req)
+	}
+	client.WriteJSON(sp3.ClientMessage{Decision: &sp3.SenderDecision{ID: req.ID, Reason: "Not now"}})
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.UNAUTHORIZED || msg.Error == nil {
+		t.Fatal("Denied sender not turned away", msg, err)
+	}
+	if msg.Error.Code != sp3.SENDERDENIED || msg.Error.Message != "Not now" {
+		t.Fatal("Denial not explained", msg.Error)
+	}
+	sender.Close()
+
+	// Accepting with tighter limits holds the sender to them.
+	sender, req = request()
+	defer sender.Close()
+	client.WriteJSON(sp3.ClientMessage{Decision: &sp3.SenderDecision{
+		ID:     req.ID,
+		Accept: true,
+		Limits: &sp3.ConsentScope{Ports: []uint16{5000}, MaxPackets: 1},
+	}})
+	if err := client.ReadJSON(&msg); err != nil || msg.Challenge == "" {
+		t.Fatal("Approved sender not challenged", msg, err)
+	}
+	sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "127.0.0.1", Challenge: msg.Challenge})
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.OKAY {
+		t.Fatal("Approved sender not authorized", msg, err)
+	}
+	dest := net.ParseIP("127.0.0.1")
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 6000))
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 5000))
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 5000))
+	select {
+	case packet := <-writer.Packets:
+		if port, _ := destinationPort(17, packet[20:]); port != 5000 {
+			t.Fatal("Packet outside the approved limits sent", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Packet within the approved limits not sent")
+	}
+	select {
+	case <-writer.Packets:
+		t.Fatal("Packet over the approved limit sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+	packets, _ := server.sessions.ConsentingClients("127.0.0.1")[0].Consent().Counters()
+	if packets != 1 {
+		t.Fatal("Approved packets not counted against the consent", packets)
+	}
+}
+
+func TestSelfApproval(t *testing.T) {
+	web := httptest.NewServer(SocketHandler(NewServer(Config{}, NewMemoryWriter(1))))
+	defer web.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(web.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The connection couldn't read its own approval request while sending.
+	conn.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{Approve: true}})
+	conn.WriteJSON(sp3.SenderHello{DestinationAddress: "127.0.0.1"})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg := sp3.ServerMessage{}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Error == nil || msg.Error.Code != sp3.SENDERDENIED {
+		t.Fatal("Self-approval not rejected", msg, err)
+	}
+}
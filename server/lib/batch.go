@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// A BatchPacketWriter can send several packets with a single call, which is
+// much cheaper than a call per packet for high-volume senders. It returns how
+// many packets were sent before any error.
+type BatchPacketWriter interface {
+	PacketWriter
+	WritePackets(packets [][]byte) (int, error)
+}
+
+// A BatchWriter queues packets and flushes them to an underlying PacketWriter
+// once size packets are waiting, or when the flush interval passes.
+// Since sending is deferred, errors from the underlying writer are logged
+// rather than returned from WritePacket. Only writers which are also
+// BatchPacketWriters, like the raw socket backend, send faster for it; the
+// pcap backend still sends each packet with its own call.
+type BatchWriter struct {
+	writer   PacketWriter
+	size     int
+	tick     <-chan time.Time
+	stopTick func()
+	queue    chan []byte
+	done     chan struct{}
+	closed   bool
+	sync.RWMutex
+}
+
+func NewBatchWriter(writer PacketWriter, size int, interval time.Duration) *BatchWriter {
+	if interval <= 0 {
+		return newBatchWriter(writer, size, nil, nil)
+	}
+	ticker := time.NewTicker(interval)
+	return newBatchWriter(writer, size, ticker.C, ticker.Stop)
+}
+
+// newBatchWriter flushes partial batches on each tick, rather than on a
+// ticker of its own, so tests can control when that happens.
+func newBatchWriter(writer PacketWriter, size int, tick <-chan time.Time, stopTick func()) *BatchWriter {
+	b := &BatchWriter{
+		writer:   writer,
+		size:     size,
+		tick:     tick,
+		stopTick: stopTick,
+		queue:    make(chan []byte, size),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// WritePacket queues a packet. The writer takes ownership of the packet,
+// which must not be modified afterwards.
+func (b *BatchWriter) WritePacket(packet []byte) error {
+	b.RLock()
+	defer b.RUnlock()
+	if b.closed {
+		return errors.New("Writer closed")
+	}
+	b.queue <- packet
+	return nil
+}
+
+func (b *BatchWriter) run() {
+	defer close(b.done)
+	if b.stopTick != nil {
+		defer b.stopTick()
+	}
+
+	batch := make([][]byte, 0, b.size)
+	for {
+		select {
+		case packet, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, packet)
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-b.tick:
+			if len(batch) > 0 {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (b *BatchWriter) flush(batch [][]byte) {
+	bw, ok := b.writer.(BatchPacketWriter)
+	if !ok {
+		for _, packet := range batch {
+			if err := b.writer.WritePacket(packet); err != nil {
+				log.Println("Couldn't send packet", err)
+			}
+		}
+		return
+	}
+
+	for len(batch) > 0 {
+		n, err := bw.WritePackets(batch)
+		if err == nil || n >= len(batch) {
+			return
+		}
+		// Skip past the packet which failed.
+		log.Println("Couldn't send packet", err)
+		batch = batch[n+1:]
+	}
+}
+
+// Close flushes queued packets, and closes the underlying writer.
+func (b *BatchWriter) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.Unlock()
+
+	<-b.done
+	return b.writer.Close()
+}
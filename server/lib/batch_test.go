@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// countingWriter drops packets, remembering how many it saw and in how many
+// calls. The size of each batch is sent to flushes, if it is set.
+type countingWriter struct {
+	packets int64
+	calls   int64
+	flushes chan int
+}
+
+func (c *countingWriter) WritePacket(packet []byte) error {
+	atomic.AddInt64(&c.packets, 1)
+	atomic.AddInt64(&c.calls, 1)
+	return nil
+}
+
+func (c *countingWriter) WritePackets(packets [][]byte) (int, error) {
+	atomic.AddInt64(&c.packets, int64(len(packets)))
+	atomic.AddInt64(&c.calls, 1)
+	if c.flushes != nil {
+		c.flushes <- len(packets)
+	}
+	return len(packets), nil
+}
+
+func (c *countingWriter) Close() error {
+	return nil
+}
+
+func udpPacket(tb testing.TB, dst net.IP, port int) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(127, 0, 0, 2),
+		DstIP:    dst,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(443),
+		DstPort: layers.UDPPort(port),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}, ip, udp, gopacket.Payload([]byte("Hello World!"))); err != nil {
+		tb.Fatal("Couldn't construct packet")
+	}
+	return buf.Bytes()
+}
+
+// flushed waits for the next batch written to counter.
+func flushed(t *testing.T, counter *countingWriter) int {
+	select {
+	case n := <-counter.flushes:
+		return n
+	case <-time.After(time.Second):
+		t.Fatal("Batch not flushed")
+		return 0
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	counter := &countingWriter{flushes: make(chan int, 2)}
+	// The clock never ticks, so only full batches and Close flush.
+	writer := newBatchWriter(counter, 4, nil, nil)
+	packet := udpPacket(t, net.IPv4(127, 0, 0, 1), 80)
+
+	// A full batch is sent in one call.
+	for i := 0; i < 4; i++ {
+		writer.WritePacket(packet)
+	}
+	if n := flushed(t, counter); n != 4 {
+		t.Fatal("Full batch not flushed together", n)
+	}
+
+	// A partial batch waits for close.
+	writer.WritePacket(packet)
+	writer.Close()
+	if n := flushed(t, counter); n != 1 || atomic.LoadInt64(&counter.calls) != 2 {
+		t.Fatal("Partial batch not flushed on close", n, counter.calls)
+	}
+	if writer.WritePacket(packet) == nil {
+		t.Fatal("Closed writer accepted packet")
+	}
+}
+
+func TestBatchWriterInterval(t *testing.T) {
+	writer := NewMemoryWriter(1)
+	tick := make(chan time.Time)
+	batch := newBatchWriter(writer, 100, tick, nil)
+	defer batch.Close()
+
+	// The packet may only be queued after a tick, so tick until it is sent.
+	batch.WritePacket(udpPacket(t, net.IPv4(127, 0, 0, 1), 80))
+	timeout := time.After(time.Second)
+	for sent := false; !sent; {
+		select {
+		case tick <- time.Now():
+		case <-writer.Packets:
+			sent = true
+		case <-timeout:
+			t.Fatal("Packet not flushed after interval")
+		}
+	}
+}
+
+func benchmarkWriter(b *testing.B, writer PacketWriter) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+	spoofer := NewSpoofer(writer)
+	dest := net.IPv4(127, 0, 0, 1)
+	packet := udpPacket(b, dest, port)
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := spoofer.SpoofIPv4Message(packet, dest, dest, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	writer.Close()
+}
+
+func BenchmarkSpoofer(b *testing.B) {
+	benchmarkWriter(b, &countingWriter{})
+}
+
+func BenchmarkRawSocketWriter(b *testing.B) {
+	writer, err := NewRawSocketWriter()
+	if err != nil {
+		b.Skip("Raw sockets unavailable:", err)
+	}
+	benchmarkWriter(b, writer)
+}
+
+func BenchmarkRawSocketBatchWriter(b *testing.B) {
+	writer, err := NewRawSocketWriter()
+	if err != nil {
+		b.Skip("Raw sockets unavailable:", err)
+	}
+	benchmarkWriter(b, NewBatchWriter(writer, 64, 10*time.Millisecond))
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// A ChallengeTracker issues challenges which can be answered once, before
+// they expire. Only one challenge may be outstanding for each key.
+type ChallengeTracker struct {
+	ttl     time.Duration
+	byToken map[string]*pendingChallenge
+	byKey   map[string]*pendingChallenge
+	sync.Mutex
+}
+
+type pendingChallenge struct {
+	token   string
+	key     string
+	expires time.Time
+}
+
+func NewChallengeTracker(ttl time.Duration) *ChallengeTracker {
+	return &ChallengeTracker{
+		ttl:     ttl,
+		byToken: make(map[string]*pendingChallenge),
+		byKey:   make(map[string]*pendingChallenge),
+	}
+}
+
+// Issue creates a challenge for key, unless one is already outstanding.
+func (c *ChallengeTracker) Issue(key string) (string, error) {
+	token, err := genToken()
+	if err != nil {
+		return "", err
+	}
+	if err = c.issue(key, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// issue records token, made by the caller, as the challenge for key.
+func (c *ChallengeTracker) issue(key string, token string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.expire()
+	if _, ok := c.byKey[key]; ok {
+		return &sp3.Error{Code: sp3.CHALLENGEPENDING, Message: "A challenge is outstanding for " + key}
+	}
+	pending := &pendingChallenge{token, key, time.Now().Add(c.ttl)}
+	c.byToken[token] = pending
+	c.byKey[key] = pending
+	return nil
+}
+
+// Redeem uses up a challenge, failing if it wasn't issued, was already used,
+// or has expired.
+func (c *ChallengeTracker) Redeem(token string) error {
+	c.Lock()
+	defer c.Unlock()
+	pending, ok := c.byToken[token]
+	if !ok {
+		return &sp3.Error{Code: sp3.CHALLENGEUNKNOWN, Message: "Challenge not issued or already used"}
+	}
+	c.remove(pending)
+	if time.Now().After(pending.expires) {
+		return &sp3.Error{Code: sp3.CHALLENGEEXPIRED, Message: "Challenge expired"}
+	}
+	return nil
+}
+
+// Cancel forgets a challenge which couldn't be delivered.
+func (c *ChallengeTracker) Cancel(token string) {
+	c.Lock()
+	defer c.Unlock()
+	if pending, ok := c.byToken[token]; ok {
+		c.remove(pending)
+	}
+}
+
+func (c *ChallengeTracker) remove(pending *pendingChallenge) {
+	delete(c.byToken, pending.token)
+	if c.byKey[pending.key] == pending {
+		delete(c.byKey, pending.key)
+	}
+}
+
+// expire drops challenges which can no longer be answered.
+func (c *ChallengeTracker) expire() {
+	now := time.Now()
+	for _, pending := range c.byToken {
+		if now.After(pending.expires) {
+			c.remove(pending)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+func code(err error) sp3.ErrorCode {
+	if protoErr, ok := err.(*sp3.Error); ok {
+		return protoErr.Code
+	}
+	return ""
+}
+
+func TestChallengeTracker(t *testing.T) {
+	tracker := NewChallengeTracker(time.Minute)
+	token, err := tracker.Issue("a")
+	if err != nil || token == "" {
+		t.Fatal("Couldn't issue challenge", err)
+	}
+	if _, err := tracker.Issue("a"); code(err) != sp3.CHALLENGEPENDING {
+		t.Fatal("Second outstanding challenge issued", err)
+	}
+	if _, err := tracker.Issue("b"); err != nil {
+		t.Fatal("Challenge for another key refused", err)
+	}
+	if err := tracker.Redeem(token); err != nil {
+		t.Fatal("Challenge not redeemed", err)
+	}
+	if err := tracker.Redeem(token); code(err) != sp3.CHALLENGEUNKNOWN {
+		t.Fatal("Challenge redeemed twice", err)
+	}
+	if _, err := tracker.Issue("a"); err != nil {
+		t.Fatal("Redeemed challenge still outstanding", err)
+	}
+
+	tracker = NewChallengeTracker(10 * time.Millisecond)
+	token, _ = tracker.Issue("a")
+	time.Sleep(20 * time.Millisecond)
+	if err := tracker.Redeem(token); code(err) != sp3.CHALLENGEEXPIRED {
+		t.Fatal("Expired challenge redeemed", err)
+	}
+	token, _ = tracker.Issue("a")
+	tracker.Cancel(token)
+	if _, err := tracker.Issue("a"); err != nil {
+		t.Fatal("Cancelled challenge still outstanding", err)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// loadRegistrarKey reads the key registrations are signed with, a base64
+// ed25519 seed.
+func loadRegistrarKey(path string) (ed25519.PrivateKey, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Bad registrar key in " + path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// register handles a key registration from the consent websocket of session.
+// A proof without a signature gets a challenge, which pending holds until the
+// signed proof comes back. It returns the reply, and the new pending
+// challenge.
+func (s *Server) register(session *Session, proof *sp3.ConsentKeyProof, pending string) (sp3.ServerMessage, string) {
+	if s.registrar == nil {
+		return sp3.ServerMessage{Status: sp3.UNSUPPORTED}, ""
+	}
+	if proof.Signature == nil {
+		challenge, err := genToken()
+		if err != nil {
+			return sp3.ServerMessage{Status: sp3.INVALID}, ""
+		}
+		return sp3.ServerMessage{Status: sp3.OKAY, Challenge: challenge}, challenge
+	}
+	if pending == "" || proof.Verify(pending) != nil {
+		return rejection(&sp3.Error{Code: sp3.BADATTESTATION, Message: "Key proof doesn't answer the challenge"}), ""
+	}
+	hours := 168
+	if s.config.RegistrationHours > 0 {
+		hours = s.config.RegistrationHours
+	}
+	expiry := time.Now().Add(time.Duration(hours) * time.Hour)
+	registration := sp3.SignConsentRegistration(s.registrar, net.ParseIP(session.Host), proof.Key, expiry)
+	return sp3.ServerMessage{Status: sp3.OKAY, Registration: registration}, ""
+}
+
+// trustedRegistrar is true for this server's own key, and those in the config.
+func (s *Server) trustedRegistrar(key []byte) bool {
+	if s.registrar != nil && string(s.registrar.Public().(ed25519.PublicKey)) == string(key) {
+		return true
+	}
+	for _, trusted := range s.config.RegistrarKeys {
+		if decoded, err := base64.StdEncoding.DecodeString(trusted); err == nil && string(decoded) == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredKey is true if key may consent for address, either through the
+// config or a registration from a trusted registrar.
+func (s *Server) registeredKey(address string, key []byte, registration *sp3.ConsentRegistration) bool {
+	for configured, encoded := range s.config.ConsentKeys {
+		if ip := net.ParseIP(configured); ip != nil && ip.String() == address && encoded == base64.StdEncoding.EncodeToString(key) {
+			return true
+		}
+	}
+	if registration == nil || registration.Address != address || string(registration.Key) != string(key) {
+		return false
+	}
+	return s.trustedRegistrar(registration.Registrar) && registration.Verify() == nil
+}
+
+// checkConsentToken verifies that the token is current consent from
+// destination.
+func (s *Server) checkConsentToken(t *sp3.ConsentToken, destination string) error {
+	if ip := net.ParseIP(t.Address); ip == nil || !ip.Equal(net.ParseIP(destination)) {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Token is for another address"}
+	}
+	if err := t.Verify(); err != nil {
+		return &sp3.Error{Code: sp3.BADATTESTATION, Message: err.Error()}
+	}
+	if t.Scope.Expiry.IsZero() {
+		return &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "Token doesn't expire"}
+	}
+	if time.Now().After(t.Scope.Expiry) {
+		return &sp3.Error{Code: sp3.CHALLENGEEXPIRED, Message: "Token expired"}
+	}
+	if !s.registeredKey(t.Address, t.Key, t.Registration) {
+		return &sp3.Error{Code: sp3.UNREGISTEREDKEY, Message: "Token key isn't registered for " + t.Address}
+	}
+	return nil
+}
+
+// tokenGrant is the grant for a token. Senders using the same token share
+// it, so that its limits apply across them.
+func (s *Server) tokenGrant(t *sp3.ConsentToken) (*Grant, error) {
+	return s.sharedGrant("token "+t.Challenge(), t.Scope)
+}
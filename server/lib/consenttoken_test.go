@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/willscott/sp3"
+)
+
+func TestConsentKeyRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registrarPublic, registrarKey, _ := ed25519.GenerateKey(rand.Reader)
+	keyFile := filepath.Join(dir, "registrar.key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(registrarKey.Seed())), 0600)
+
+	conf := Config{PathReflectionFile: "../pathreflection.json", RegistrarKeyFile: keyFile}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, NewMemoryWriter(1))))
+	defer web.Close()
+
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	sp3url := url.URL{Scheme: "ws", Host: strings.TrimPrefix(web.URL, "http://")}
+	registration, err := sp3.RegisterConsentKey(sp3url, clientKey, nil)
+	if err != nil {
+		t.Fatal("Registration failed", err)
+	}
+	if registration.Address != "127.0.0.1" || registration.Verify() != nil {
+		t.Fatal("Bad registration", registration)
+	}
+
+	// Other servers accept tokens registered with a registrar they trust.
+	scope := sp3.ConsentScope{Protocols: []int{17}, Expiry: time.Now().Add(time.Minute)}
+	token, err := sp3.SignConsentToken(clientKey, net.IP{127, 0, 0, 1}, scope, registration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusting := NewServer(Config{
+		PathReflectionFile: "../pathreflection.json",
+		RegistrarKeys:      []string{base64.StdEncoding.EncodeToString(registrarPublic)},
+	}, NewMemoryWriter(1))
+	if err := trusting.checkConsentToken(token, "127.0.0.1"); err != nil {
+		t.Fatal("Registered token rejected", err)
+	}
+	untrusting := NewServer(Config{PathReflectionFile: "../pathreflection.json"}, NewMemoryWriter(1))
+	if code(untrusting.checkConsentToken(token, "127.0.0.1")) != sp3.UNREGISTEREDKEY {
+		t.Fatal("Token accepted without trusting its registrar")
+	}
+
+	// Registrations can't be claimed for a key without answering the challenge.
+	client, _, err := websocket.DefaultDialer.Dial(sp3url.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteJSON(sp3.ClientMessage{Register: sp3.ProveConsentKey(clientKey, "guessed")})
+	msg := sp3.ServerMessage{}
+	if err := client.ReadJSON(&msg); err != nil || msg.Registration != nil || msg.Status != sp3.UNAUTHORIZED {
+		t.Fatal("Unchallenged key registered", msg, err)
+	}
+}
+
+func TestCheckConsentToken(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	s := NewServer(Config{
+		PathReflectionFile: "../pathreflection.json",
+		ConsentKeys:        map[string]string{"1.2.3.4": base64.StdEncoding.EncodeToString(public)},
+	}, NewMemoryWriter(1))
+	dest := net.ParseIP("1.2.3.4")
+	scope := sp3.ConsentScope{Expiry: time.Now().Add(time.Minute)}
+
+	valid, _ := sp3.SignConsentToken(key, dest, scope, nil)
+	// Tokens are checked after a trip through JSON, as senders send them.
+	data, _ := json.Marshal(valid)
+	valid = &sp3.ConsentToken{}
+	json.Unmarshal(data, valid)
+	if err := s.checkConsentToken(valid, "1.2.3.4"); err != nil {
+		t.Fatal("Valid token rejected", err)
+	}
+
+	// The signature doesn't depend on how the scope is encoded.
+	wide := sp3.ConsentScope{Protocols: []int{6, 17}, Ports: []uint16{5000}, SourcePrefixes: []string{"10.0.0.0/8"}, Expiry: scope.Expiry}
+	reencoded, _ := sp3.SignConsentToken(key, dest, wide, nil)
+	reencoded.Scope.Expiry = reencoded.Scope.Expiry.In(time.FixedZone("", 3600))
+	data, _ = json.MarshalIndent(reencoded, "", "  ")
+	reencoded = &sp3.ConsentToken{}
+	json.Unmarshal(data, reencoded)
+	if err := s.checkConsentToken(reencoded, "1.2.3.4"); err != nil {
+		t.Fatal("Re-encoded token rejected", err)
+	}
+
+	tampered, _ := sp3.SignConsentToken(key, dest, scope, nil)
+	tampered.Scope.MaxPackets = 10
+	widened, _ := sp3.SignConsentToken(key, dest, wide, nil)
+	widened.Scope.Ports = append(widened.Scope.Ports, 22)
+	expired, _ := sp3.SignConsentToken(key, dest, sp3.ConsentScope{Expiry: time.Now().Add(-time.Minute)}, nil)
+	unregistered, _ := sp3.SignConsentToken(other, dest, scope, nil)
+	cases := []struct {
+		token       *sp3.ConsentToken
+		destination string
+		code        sp3.ErrorCode
+	}{
+		{valid, "5.6.7.8", sp3.DESTINATIONMISMATCH},
+		{tampered, "1.2.3.4", sp3.BADATTESTATION},
+		{widened, "1.2.3.4", sp3.BADATTESTATION},
+		{expired, "1.2.3.4", sp3.CHALLENGEEXPIRED},
+		{unregistered, "1.2.3.4", sp3.UNREGISTEREDKEY},
+	}
+	for i, c := range cases {
+		if got := code(s.checkConsentToken(c.token, c.destination)); got != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, got)
+		}
+	}
+	if _, err := sp3.SignConsentToken(key, dest, sp3.ConsentScope{}, nil); err == nil {
+		t.Fatal("Token signed without an expiry")
+	}
+}
+
+func TestConsentTokenSenders(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	writer := NewMemoryWriter(2)
+	conf := Config{
+		PathReflectionFile: "../pathreflection.json",
+		ConsentKeys:        map[string]string{"1.2.3.4": base64.StdEncoding.EncodeToString(public)},
+	}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, writer)))
+	defer web.Close()
+
+	dest := net.ParseIP("1.2.3.4")
+	scope := sp3.ConsentScope{Ports: []uint16{5000}, MaxPackets: 1, Expiry: time.Now().Add(time.Minute)}
+	token, _ := sp3.SignConsentToken(key, dest, scope, nil)
+	opts, _ := json.Marshal(token)
+	authorize := func() *websocket.Conn {
+		sender, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(web.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.WriteJSON(sp3.SenderHello{
+			DestinationAddress:    "1.2.3.4",
+			AuthenticationMethod:  sp3.CONSENTTOKEN,
+			AuthenticationOptions: opts,
+		})
+		sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "1.2.3.4", Challenge: token.Challenge()})
+		msg := sp3.ServerMessage{}
+		if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.OKAY {
+			t.Fatal("Token not accepted", msg, err)
+		}
+		return sender
+	}
+	delivered := func(sender *websocket.Conn, port int) bool {
+		sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, port))
+		select {
+		case <-writer.Packets:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	first := authorize()
+	defer first.Close()
+	if delivered(first, 6000) {
+		t.Fatal("Packet outside the token's scope sent")
+	}
+	if !delivered(first, 5000) {
+		t.Fatal("Packet within the token's scope not sent")
+	}
+
+	// The token's limits cover every sender using it.
+	second := authorize()
+	defer second.Close()
+	if delivered(second, 5000) {
+		t.Fatal("Packet limit not shared between senders")
+	}
+}
@@ -0,0 +1,141 @@
+/**
+ * This file is part of the SP^3 server, implementing the "DNS reflection" form
+ * of IP verification - namely the injection of a spoofed DNS query from the
+ * client's UDP binding with a recursive resolver, whose answer carries the
+ * token back to the client in its question.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/willscott/sp3"
+)
+
+type DNSReflectionState struct {
+	ResolverIP   net.IP
+	ResolverPort uint16
+	ClientIP     net.IP
+	ClientPort   uint16
+}
+
+const dnsPort = 53
+
+// Names under .invalid are answered with NXDOMAIN, often by the resolver
+// itself, so queries for them don't go any further.
+const defaultDNSReflectionZone = "sp3.invalid"
+
+// Validate checks that the state describes a binding between destination and
+// a resolver, so that the server can't be made to send queries from other
+// addresses.
+func (state *DNSReflectionState) Validate(destination string) error {
+	if state.ClientIP == nil || state.ResolverIP == nil {
+		return &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "Client and resolver addresses are required"}
+	}
+	if !state.ClientIP.Equal(net.ParseIP(destination)) {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Client address must be the destination"}
+	}
+	if !routableUnicast(state.ClientIP) || !routableUnicast(state.ResolverIP) {
+		return &sp3.Error{Code: sp3.UNROUTABLEADDRESS, Message: "Addresses must be routable IPv4 unicast"}
+	}
+	if state.ResolverPort != dnsPort {
+		return &sp3.Error{Code: sp3.BADPORT, Message: fmt.Sprintf("Resolver port must be %d", dnsPort)}
+	}
+	if state.ClientPort < 1024 {
+		return &sp3.Error{Code: sp3.BADPORT, Message: "Client port must be unprivileged"}
+	}
+	return nil
+}
+
+// key identifies the binding the state describes.
+func (state *DNSReflectionState) key() string {
+	return fmt.Sprintf("udp %v:%d-%v:%d", state.ClientIP, state.ClientPort, state.ResolverIP, state.ResolverPort)
+}
+
+// trustedResolver is true for the resolvers in the config.
+func (s *Server) trustedResolver(ip net.IP) bool {
+	for _, resolver := range s.config.DNSResolvers {
+		if ip.Equal(net.ParseIP(resolver)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendDNSReflectionChallenge injects a query carrying a new challenge into
+// the binding described by state. The challenge can be redeemed once.
+func (s *Server) SendDNSReflectionChallenge(state *DNSReflectionState) (string, error) {
+	token, err := s.reflections.Issue(state.key())
+	if err != nil {
+		return "", err
+	}
+	zone := s.config.DNSReflectionZone
+	if zone == "" {
+		zone = defaultDNSReflectionZone
+	}
+	id := make([]byte, 2)
+	if _, err = rand.Read(id); err != nil {
+		s.reflections.Cancel(token)
+		return "", err
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    state.ClientIP,
+		DstIP:    state.ResolverIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(state.ClientPort),
+		DstPort: layers.UDPPort(state.ResolverPort),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	dns := &layers.DNS{
+		ID:     binary.BigEndian.Uint16(id),
+		OpCode: layers.DNSOpCodeQuery,
+		RD:     true,
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(sp3.DNSChallengeName(token, zone)),
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err = gopacket.SerializeLayers(buf, opts, ip, udp, dns); err != nil {
+		s.reflections.Cancel(token)
+		return "", err
+	}
+
+	if err = s.spoofer.SpoofIPv4Message(buf.Bytes(), state.ClientIP, state.ResolverIP, nil); err != nil {
+		s.reflections.Cancel(token)
+		return "", err
+	}
+	return token, nil
+}
+
+// DNSResolverHandler publishes the resolvers trusted for DNS reflection.
+func DNSResolverHandler(server *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolvers := server.config.DNSResolvers
+		if resolvers == nil {
+			resolvers = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resolvers)
+	})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/gorilla/websocket"
+
+	"github.com/willscott/sp3"
+)
+
+// dnsChallenge reads the challenge from a spoofed DNS reflection query.
+func dnsChallenge(t *testing.T, writer *MemoryWriter) (*layers.UDP, string) {
+	select {
+	case packet := <-writer.Packets:
+		decoded := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+		udp, _ := decoded.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		dns, _ := decoded.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if udp == nil || dns == nil || len(dns.Questions) != 1 {
+			t.Fatal("Spoofed packet isn't a DNS query", decoded)
+		}
+		name := string(dns.Questions[0].Name)
+		if !strings.HasSuffix(name, "."+defaultDNSReflectionZone) {
+			t.Fatal("Query outside the zone", name)
+		}
+		token, ok := sp3.DNSChallengeToken(strings.ToUpper(name))
+		if !ok {
+			t.Fatal("No challenge in query", name)
+		}
+		return udp, token
+	case <-time.After(time.Second):
+		t.Fatal("Query not sent")
+	}
+	return nil, ""
+}
+
+func TestDNSReflection(t *testing.T) {
+	writer := NewMemoryWriter(1)
+	conf := Config{PathReflectionFile: "../pathreflection.json", DNSResolvers: []string{"8.8.8.8"}}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, writer)))
+	defer web.Close()
+
+	hello := func(resolver string) *websocket.Conn {
+		sender, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(web.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, _ := json.Marshal(&DNSReflectionState{
+			ResolverIP:   net.ParseIP(resolver),
+			ResolverPort: 53,
+			ClientIP:     net.ParseIP("1.2.3.4"),
+			ClientPort:   40000,
+		})
+		sender.WriteJSON(sp3.SenderHello{
+			DestinationAddress:    "1.2.3.4",
+			AuthenticationMethod:  sp3.DNSREFLECTION,
+			AuthenticationOptions: opts,
+		})
+		return sender
+	}
+
+	// Only trusted resolvers are sent queries.
+	sender := hello("9.9.9.9")
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Error == nil || msg.Error.Code != sp3.UNTRUSTEDREFLECTOR {
+		t.Fatal("Query sent to an untrusted resolver", msg, err)
+	}
+	sender.Close()
+
+	sender = hello("8.8.8.8")
+	defer sender.Close()
+	udp, token := dnsChallenge(t, writer)
+	if udp.SrcPort != 40000 || udp.DstPort != 53 {
+		t.Fatal("Query not sent on the client's binding", udp.SrcPort, udp.DstPort)
+	}
+	sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "1.2.3.4", Challenge: token})
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.OKAY {
+		t.Fatal("Reflected challenge not accepted", msg.Status, err)
+	}
+}
+
+func TestDNSReflectionValidate(t *testing.T) {
+	valid := func() *DNSReflectionState {
+		return &DNSReflectionState{
+			ResolverIP:   net.ParseIP("8.8.8.8"),
+			ResolverPort: 53,
+			ClientIP:     net.ParseIP("1.2.3.4"),
+			ClientPort:   40000,
+		}
+	}
+	if err := valid().Validate("1.2.3.4"); err != nil {
+		t.Fatal("Valid state rejected", err)
+	}
+
+	cases := []struct {
+		change func(*DNSReflectionState)
+		code   sp3.ErrorCode
+	}{
+		{func(s *DNSReflectionState) { s.ClientIP = net.ParseIP("5.6.7.8") }, sp3.DESTINATIONMISMATCH},
+		{func(s *DNSReflectionState) { s.ResolverIP = nil }, sp3.MALFORMEDOPTIONS},
+		{func(s *DNSReflectionState) { s.ResolverIP = net.ParseIP("192.168.1.1") }, sp3.UNROUTABLEADDRESS},
+		{func(s *DNSReflectionState) { s.ResolverPort = 5353 }, sp3.BADPORT},
+		{func(s *DNSReflectionState) { s.ClientPort = 53 }, sp3.BADPORT},
+	}
+	for i, c := range cases {
+		state := valid()
+		c.change(state)
+		err, ok := state.Validate("1.2.3.4").(*sp3.Error)
+		if !ok || err.Code != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, err)
+		}
+	}
+}
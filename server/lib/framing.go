@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A Framing builds the link-layer header for packets written to a pcap
+// handle, based on its link type.
+type Framing struct {
+	LinkType layers.LinkType
+	VLAN     uint16 // 802.1Q tag for Ethernet links, if non-zero
+}
+
+// Append adds the framed packet to buf. The MAC addresses are only used on
+// link types which carry them, and may be nil elsewhere.
+func (f Framing) Append(buf []byte, src, dst net.HardwareAddr, packet []byte) ([]byte, error) {
+	version := ipVersion(packet)
+	if version == 0 {
+		return buf, errNotIP
+	}
+	etherType := layers.EthernetTypeIPv4
+	if version == 6 {
+		etherType = layers.EthernetTypeIPv6
+	}
+
+	switch f.LinkType {
+	case layers.LinkTypeEthernet:
+		buf = appendMAC(buf, dst)
+		buf = appendMAC(buf, src)
+		if f.VLAN != 0 {
+			buf = appendUint16(buf, uint16(layers.EthernetTypeDot1Q))
+			buf = appendUint16(buf, f.VLAN&0x0fff)
+		}
+		buf = appendUint16(buf, uint16(etherType))
+	case layers.LinkTypeRaw, layers.LinkType(12), layers.LinkType(14):
+		// Raw IP, which some platforms number differently.
+	case layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if (version == 4) != (f.LinkType == layers.LinkTypeIPv4) {
+			return buf, errors.New("Link doesn't carry IPv" + strconv.Itoa(version))
+		}
+	case layers.LinkTypeLinuxSLL:
+		// Cooked header: packet type, ARPHRD type, and source address.
+		buf = appendUint16(buf, 4) // LINUX_SLL_OUTGOING
+		if len(src) > 0 {
+			buf = appendUint16(buf, 1) // ARPHRD_ETHER
+		} else {
+			buf = appendUint16(buf, 0xfffe) // ARPHRD_NONE
+		}
+		addr := make([]byte, 8)
+		copy(addr, src)
+		buf = appendUint16(buf, uint16(len(src)))
+		buf = append(buf, addr...)
+		buf = appendUint16(buf, uint16(etherType))
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		// The address family of the packet, in host or network order.
+		family := uint32(syscall.AF_INET)
+		if version == 6 {
+			family = uint32(syscall.AF_INET6)
+		}
+		header := make([]byte, 4)
+		if f.LinkType == layers.LinkTypeLoop {
+			binary.BigEndian.PutUint32(header, family)
+		} else {
+			*(*uint32)(unsafe.Pointer(&header[0])) = family
+		}
+		buf = append(buf, header...)
+	case layers.LinkTypePPP:
+		protocol := uint16(0x0021)
+		if version == 6 {
+			protocol = 0x0057
+		}
+		buf = append(buf, 0xff, 0x03)
+		buf = appendUint16(buf, protocol)
+	default:
+		return buf, errors.New("Unsupported link type: " + f.LinkType.String())
+	}
+	return append(buf, packet...), nil
+}
+
+// appendMAC adds an Ethernet address, using zeros if it's unknown, as on
+// loopback interfaces.
+func appendMAC(buf []byte, mac net.HardwareAddr) []byte {
+	if len(mac) != 6 {
+		return append(buf, 0, 0, 0, 0, 0, 0)
+	}
+	return append(buf, mac...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestFraming(t *testing.T) {
+	packet := udpPacket(t, net.IPv4(127, 0, 0, 1), 80)
+	src, _ := net.ParseMAC("02:00:00:00:00:01")
+	dst, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	for _, linkType := range []layers.LinkType{
+		layers.LinkTypeEthernet,
+		layers.LinkTypeRaw,
+		layers.LinkTypeLinuxSLL,
+		layers.LinkTypeNull,
+		layers.LinkTypeLoop,
+		layers.LinkTypePPP,
+	} {
+		frame, err := Framing{LinkType: linkType}.Append(nil, src, dst, packet)
+		if err != nil {
+			t.Fatal("Couldn't frame for", linkType, err)
+		}
+		if !bytes.HasSuffix(frame, packet) {
+			t.Fatal("Frame doesn't end with packet for", linkType)
+		}
+		decoded := gopacket.NewPacket(frame, linkType, gopacket.Default)
+		if decoded.Layer(layers.LayerTypeIPv4) == nil || decoded.Layer(layers.LayerTypeUDP) == nil {
+			t.Fatal("Frame not understood for", linkType, decoded)
+		}
+	}
+}
+
+func TestFramingVLAN(t *testing.T) {
+	packet := udpPacket(t, net.IPv4(127, 0, 0, 1), 80)
+	frame, err := Framing{LinkType: layers.LinkTypeEthernet, VLAN: 42}.Append(nil, nil, nil, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+	tag, ok := decoded.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok || tag.VLANIdentifier != 42 || decoded.Layer(layers.LayerTypeIPv4) == nil {
+		t.Fatal("VLAN tag not understood", decoded)
+	}
+
+	if _, err = (Framing{LinkType: layers.LinkTypeIPv6}).Append(nil, nil, nil, packet); err == nil {
+		t.Fatal("IPv4 packet framed for an IPv6 link")
+	}
+}
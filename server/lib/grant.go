@@ -0,0 +1,217 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// A Grant is the consent a client has given to receive spoofed packets, and
+// the traffic which has been sent under it. Consent ends when the grant is
+// revoked, which happens at its expiry, when the client asks, or when the
+// client disconnects.
+type Grant struct {
+	Client  *Session
+	Scope   sp3.ConsentScope
+	Approve bool // Senders are approved by the client before being challenged
+
+	parent   *Grant // A grant narrowed for one sender is within its parent
+	prefixes []*net.IPNet
+	packets  uint64
+	bytes    uint64
+	dropped  uint64
+	account  senderAccount
+	done     chan struct{}
+	revoke   sync.Once
+	sync.Mutex
+}
+
+var (
+	errExpired     = errors.New("Consent expired")
+	errRevoked     = errors.New("Consent revoked")
+	errPacketLimit = errors.New("Packet limit reached")
+	errByteLimit   = errors.New("Byte limit reached")
+)
+
+func NewGrant(client *Session, scope sp3.ConsentScope) (*Grant, error) {
+	grant := &Grant{Client: client, Scope: scope, done: make(chan struct{})}
+	for _, prefix := range scope.SourcePrefixes {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		grant.prefixes = append(grant.prefixes, network)
+	}
+	if !scope.Expiry.IsZero() {
+		time.AfterFunc(scope.Expiry.Sub(time.Now()), grant.Revoke)
+	}
+	return grant, nil
+}
+
+// Narrow makes a grant for one sender, within both scope and the grant's own.
+// It ends when the grant does.
+func (g *Grant) Narrow(scope sp3.ConsentScope) (*Grant, error) {
+	child, err := NewGrant(g.Client, scope)
+	if err != nil {
+		return nil, err
+	}
+	child.parent = g
+	go func() {
+		select {
+		case <-g.Done():
+			child.Revoke()
+		case <-child.Done():
+		}
+		g.removeSender(child)
+	}()
+	return child, nil
+}
+
+// Revoke ends the grant. It is safe to call more than once.
+func (g *Grant) Revoke() {
+	g.revoke.Do(func() {
+		close(g.done)
+	})
+}
+
+// Done is closed once the grant is revoked, so that the senders relying on it
+// can be stopped.
+func (g *Grant) Done() <-chan struct{} {
+	return g.done
+}
+
+// Revoked is true once consent has been withdrawn or has expired.
+func (g *Grant) Revoked() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Expired is true once the grant's scope has passed its expiry.
+func (g *Grant) Expired() bool {
+	return !g.Scope.Expiry.IsZero() && time.Now().After(g.Scope.Expiry)
+}
+
+// Permit checks a packet against the scope of the grant, and counts it
+// against the grant's limits if it is allowed. port is only meaningful when
+// hasPort is set, for TCP and UDP packets.
+func (g *Grant) Permit(src net.IP, protocol int, port uint16, hasPort bool, size int) error {
+	for grant := g; grant != nil; grant = grant.parent {
+		if err := grant.allows(src, protocol, port, hasPort); err != nil {
+			g.Drop()
+			return err
+		}
+	}
+	if err := g.count(size); err != nil {
+		g.Drop()
+		return err
+	}
+	g.addSource(src)
+	return nil
+}
+
+// allows checks a packet against the scope of the grant, but not its limits.
+func (g *Grant) allows(src net.IP, protocol int, port uint16, hasPort bool) error {
+	if g.Revoked() {
+		return errRevoked
+	}
+	if g.Expired() {
+		return errExpired
+	}
+	if len(g.Scope.Protocols) > 0 && !containsInt(g.Scope.Protocols, protocol) {
+		return errors.New("Protocol not permitted")
+	}
+	if len(g.Scope.Ports) > 0 && (!hasPort || !containsPort(g.Scope.Ports, port)) {
+		return errors.New("Port not permitted")
+	}
+	if len(g.prefixes) > 0 {
+		allowed := false
+		for _, prefix := range g.prefixes {
+			if prefix.Contains(src) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("Source not permitted")
+		}
+	}
+	return nil
+}
+
+// count counts a packet against the limits of the grant and its parents,
+// unless one of them is reached.
+func (g *Grant) count(size int) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.Scope.MaxPackets > 0 && g.packets >= g.Scope.MaxPackets {
+		return errPacketLimit
+	}
+	if g.Scope.MaxBytes > 0 && g.bytes+uint64(size) > g.Scope.MaxBytes {
+		return errByteLimit
+	}
+	if g.parent != nil {
+		if err := g.parent.count(size); err != nil {
+			return err
+		}
+	}
+	g.packets++
+	g.bytes += uint64(size)
+	return nil
+}
+
+// Counters returns the packets and bytes sent under the grant.
+func (g *Grant) Counters() (packets uint64, bytes uint64) {
+	g.Lock()
+	defer g.Unlock()
+	return g.packets, g.bytes
+}
+
+func containsInt(list []int, val int) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(list []uint16, val uint16) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedGrant is the grant for consent which doesn't come from a connected
+// client, identified by key. It is shared by the senders relying on the same
+// consent until it ends.
+func (s *Server) sharedGrant(key string, scope sp3.ConsentScope) (*Grant, error) {
+	s.grantLock.Lock()
+	defer s.grantLock.Unlock()
+	if grant, ok := s.sharedGrants[key]; ok && !grant.Revoked() {
+		return grant, nil
+	}
+	grant, err := NewGrant(nil, scope)
+	if err != nil {
+		return nil, err
+	}
+	s.sharedGrants[key] = grant
+	go func() {
+		<-grant.Done()
+		s.grantLock.Lock()
+		defer s.grantLock.Unlock()
+		if s.sharedGrants[key] == grant {
+			delete(s.sharedGrants, key)
+		}
+	}()
+	return grant, nil
+}
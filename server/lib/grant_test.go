@@ -0,0 +1,188 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+func TestGrantPermit(t *testing.T) {
+	if _, err := NewGrant(nil, sp3.ConsentScope{SourcePrefixes: []string{"not a prefix"}}); err == nil {
+		t.Fatal("Bad prefix accepted")
+	}
+	grant, err := NewGrant(nil, sp3.ConsentScope{
+		Protocols:      []int{17},
+		Ports:          []uint16{5000},
+		SourcePrefixes: []string{"10.0.0.0/8"},
+		MaxPackets:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := net.ParseIP("10.1.2.3")
+	if err := grant.Permit(src, 6, 5000, true, 100); err == nil {
+		t.Fatal("Protocol outside of scope permitted")
+	}
+	if err := grant.Permit(src, 17, 6000, true, 100); err == nil {
+		t.Fatal("Port outside of scope permitted")
+	}
+	if err := grant.Permit(src, 17, 0, false, 100); err == nil {
+		t.Fatal("Packet without a port permitted")
+	}
+	if err := grant.Permit(net.ParseIP("192.0.2.1"), 17, 5000, true, 100); err == nil {
+		t.Fatal("Source outside of scope permitted")
+	}
+	for i := 0; i < 2; i++ {
+		if err := grant.Permit(src, 17, 5000, true, 100); err != nil {
+			t.Fatal("Packet within scope denied", err)
+		}
+	}
+	if err := grant.Permit(src, 17, 5000, true, 100); err != errPacketLimit {
+		t.Fatal("Packet limit not enforced", err)
+	}
+	if packets, bytes := grant.Counters(); packets != 2 || bytes != 200 {
+		t.Fatal("Permitted packets not counted", packets, bytes)
+	}
+
+	grant, _ = NewGrant(nil, sp3.ConsentScope{MaxBytes: 150})
+	if err := grant.Permit(src, 6, 0, false, 100); err != nil {
+		t.Fatal("Unscoped packet denied", err)
+	}
+	if err := grant.Permit(src, 6, 0, false, 100); err != errByteLimit {
+		t.Fatal("Byte limit not enforced", err)
+	}
+
+	grant, _ = NewGrant(nil, sp3.ConsentScope{Expiry: time.Now().Add(-time.Second)})
+	if err := grant.Permit(src, 6, 0, false, 100); err != errExpired {
+		t.Fatal("Expired consent honored", err)
+	}
+}
+
+func TestScopedConsent(t *testing.T) {
+	writer := NewMemoryWriter(5)
+	server := NewServer(Config{}, writer)
+	web := httptest.NewServer(SocketHandler(server))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+
+	// Without a consenting client, senders are turned away.
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.WriteJSON(sp3.SenderHello{DestinationAddress: "127.0.0.1"})
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.UNAUTHORIZED {
+		t.Fatal("Sender authorized without consent", msg.Status, err)
+	}
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{
+		Scope: sp3.ConsentScope{Ports: []uint16{5000}},
+	}})
+	// Let the server record the consent before a sender arrives.
+	time.Sleep(50 * time.Millisecond)
+
+	sender = authorizeSender(t, url, client)
+	defer sender.Close()
+
+	dest := net.ParseIP("127.0.0.1")
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 6000))
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 5000))
+	select {
+	case packet := <-writer.Packets:
+		if port, _ := destinationPort(17, packet[20:]); port != 5000 {
+			t.Fatal("Packet outside of consent delivered", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Packet within consent not delivered")
+	}
+}
+
+func TestGrantRevoke(t *testing.T) {
+	grant, _ := NewGrant(nil, sp3.ConsentScope{Expiry: time.Now().Add(50 * time.Millisecond)})
+	if grant.Revoked() {
+		t.Fatal("New grant revoked")
+	}
+	select {
+	case <-grant.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Grant not revoked at expiry")
+	}
+	grant.Revoke()
+	if err := grant.Permit(net.ParseIP("10.0.0.1"), 6, 0, false, 10); err != errRevoked {
+		t.Fatal("Revoked grant honored", err)
+	}
+}
+
+// authorizeSender connects a sender to dest through a consenting client.
+func authorizeSender(t *testing.T, url string, client *websocket.Conn) *websocket.Conn {
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.WriteJSON(sp3.SenderHello{DestinationAddress: "127.0.0.1"})
+	msg := sp3.ServerMessage{}
+	if err := client.ReadJSON(&msg); err != nil || msg.Challenge == "" {
+		t.Fatal("Consenting client didn't get a challenge", err)
+	}
+	sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "127.0.0.1", Challenge: msg.Challenge})
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.OKAY {
+		t.Fatal("Sender not authorized", msg.Status, err)
+	}
+	return sender
+}
+
+func TestConsentRevocation(t *testing.T) {
+	server := NewServer(Config{}, NewMemoryWriter(5))
+	web := httptest.NewServer(SocketHandler(server))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{}})
+	time.Sleep(50 * time.Millisecond)
+
+	// An explicit revocation stops the sender.
+	sender := authorizeSender(t, url, client)
+	defer sender.Close()
+	client.WriteJSON(sp3.ClientMessage{Revoke: true})
+	msg := sp3.ServerMessage{}
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.REVOKED {
+		t.Fatal("Sender not told of revocation", msg.Status, err)
+	}
+	if _, _, err := sender.ReadMessage(); err == nil {
+		t.Fatal("Sender still connected after revocation")
+	}
+	// The client hears that its consent has ended too.
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if err := client.ReadJSON(&msg); err != nil || msg.Status != sp3.REVOKED {
+		t.Fatal("Client not told of revocation", msg.Status, err)
+	}
+	client.SetReadDeadline(time.Time{})
+
+	// Consenting again, and then disconnecting, stops the next sender.
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{}})
+	time.Sleep(50 * time.Millisecond)
+	sender = authorizeSender(t, url, client)
+	defer sender.Close()
+	client.Close()
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.REVOKED {
+		t.Fatal("Sender outlived the client", msg.Status, err)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/willscott/sp3"
+)
+
+// Posts to the mailbox are no larger than this.
+const maxMailboxPost = 4096
+
+// A Mailbox holds the senders waiting for a consenting client to relay their
+// WEBSOCKET challenge, by the PublicKey in their hello. Only the client at the
+// destination of the hello can post to the sender, and what it posts is
+// sealed, so the mailbox passes challenges on without learning them.
+type Mailbox struct {
+	boxes map[string]mailboxEntry
+	sync.Mutex
+}
+
+type mailboxEntry struct {
+	destination string
+	sender      *Session
+}
+
+func NewMailbox() *Mailbox {
+	return &Mailbox{boxes: make(map[string]mailboxEntry)}
+}
+
+func mailboxKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// checkRelayKey makes sure key is an X25519 public key, which challenges can
+// be sealed to.
+func checkRelayKey(key []byte) error {
+	if len(key) != 32 {
+		return &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "PublicKey isn't an X25519 key"}
+	}
+	return nil
+}
+
+// Open starts taking posts for sender, from clients at destination.
+func (m *Mailbox) Open(key []byte, destination string, sender *Session) error {
+	if err := checkRelayKey(key); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.boxes[mailboxKey(key)]; ok {
+		return &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "PublicKey is already waiting for a challenge"}
+	}
+	m.boxes[mailboxKey(key)] = mailboxEntry{destination, sender}
+	return nil
+}
+
+// Close stops taking posts for key.
+func (m *Mailbox) Close(key []byte) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.boxes, mailboxKey(key))
+}
+
+// Deliver passes a sealed challenge posted from host on to the sender with
+// key, as long as host is its destination.
+func (m *Mailbox) Deliver(key []byte, host string, sealed []byte) error {
+	m.Lock()
+	entry, ok := m.boxes[mailboxKey(key)]
+	m.Unlock()
+	if !ok {
+		return &sp3.Error{Code: sp3.CHALLENGEUNKNOWN, Message: "No sender is waiting with that key"}
+	}
+	if entry.destination != host {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "The sender isn't authenticating to " + host}
+	}
+	return entry.sender.Send(sp3.ServerMessage{Status: sp3.OKAY, Sealed: sealed})
+}
+
+// MailboxHandler takes sealed challenges posted by consenting clients.
+func MailboxHandler(server *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Challenges are posted", http.StatusMethodNotAllowed)
+			return
+		}
+		post := sp3.MailboxPost{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMailboxPost)).Decode(&post); err != nil || len(post.Sealed) == 0 {
+			http.Error(w, "Malformed post", http.StatusBadRequest)
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if ip == nil {
+			http.Error(w, "Client address unknown", http.StatusBadRequest)
+			return
+		}
+		err := server.mailbox.Deliver(post.Key, ip.String(), post.Sealed)
+		if protoErr, ok := err.(*sp3.Error); ok && protoErr.Code == sp3.CHALLENGEUNKNOWN {
+			http.Error(w, protoErr.Message, http.StatusNotFound)
+		} else if ok {
+			http.Error(w, protoErr.Message, http.StatusForbidden)
+		} else if err != nil {
+			http.Error(w, "Sender disconnected", http.StatusGone)
+		} else {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})
+}
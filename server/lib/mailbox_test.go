@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+func TestRelayedChallenge(t *testing.T) {
+	server := NewServer(Config{}, NewMemoryWriter(1))
+	mux := http.NewServeMux()
+	mux.Handle("/sp3", SocketHandler(server))
+	mux.Handle("/mailbox", MailboxHandler(server))
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	sp3url := url.URL{Scheme: "ws", Host: strings.TrimPrefix(web.URL, "http://"), Path: "/sp3"}
+
+	client, _, err := websocket.DefaultDialer.Dial(sp3url.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{}})
+	time.Sleep(50 * time.Millisecond)
+
+	type dialed struct {
+		conn *sp3.Sp3Conn
+		err  error
+	}
+	result := make(chan dialed)
+	go func() {
+		conn, err := sp3.Dial(sp3url, net.IP{127, 0, 0, 1}, sp3.RelayedAuth{}, nil)
+		result <- dialed{conn, err}
+	}()
+
+	msg := sp3.ServerMessage{}
+	if err := client.ReadJSON(&msg); err != nil || len(msg.Sealed) == 0 || len(msg.PublicKey) != 32 {
+		t.Fatal("Client not asked to relay a challenge", msg, err)
+	}
+	// The client's connection doesn't carry the challenge in the clear.
+	if msg.Challenge != "" {
+		t.Fatal("Relayed challenge sent to the client unsealed")
+	}
+	// Only the sender's key opens what is relayed.
+	other := msg
+	other.PublicKey = make([]byte, 32)
+	other.PublicKey[0] = 9
+	if err := sp3.RelayChallenge(sp3url, other, nil); err == nil {
+		t.Fatal("Challenge relayed to a sender that isn't waiting")
+	}
+	if err := server.mailbox.Deliver(msg.PublicKey, "192.0.2.1", []byte("sealed")); code(err) != sp3.DESTINATIONMISMATCH {
+		t.Fatal("Challenge relayed from a host other than the destination", err)
+	}
+	if err := sp3.RelayChallenge(sp3url, msg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			t.Fatal("Relayed challenge not accepted", r.err)
+		}
+		r.conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Sender didn't pick up the relayed challenge")
+	}
+	// The mailbox closes once the sender is authorized.
+	if err := sp3.RelayChallenge(sp3url, msg, nil); err == nil {
+		t.Fatal("Mailbox still open after authorization")
+	}
+
+	// Keys which challenges can't be sealed to don't get a mailbox.
+	sender, _, err := websocket.DefaultDialer.Dial(sp3url.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.WriteJSON(sp3.SenderHello{DestinationAddress: "127.0.0.1", PublicKey: []byte("short")})
+	if err := sender.ReadJSON(&msg); err != nil || msg.Error == nil || msg.Error.Code != sp3.MALFORMEDOPTIONS {
+		t.Fatal("Malformed key accepted", msg, err)
+	}
+	server.mailbox.Lock()
+	defer server.mailbox.Unlock()
+	if len(server.mailbox.boxes) != 0 {
+		t.Fatal("Malformed key registered in the mailbox")
+	}
+}
+
+func TestSealChallenge(t *testing.T) {
+	key, _ := sp3.NewMailboxKey()
+	sealed, err := sp3.SealChallenge(key.PublicKey().Bytes(), "challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "challenge") {
+		t.Fatal("Challenge not hidden")
+	}
+	if challenge, err := sp3.OpenChallenge(key, sealed); err != nil || challenge != "challenge" {
+		t.Fatal("Sealed challenge not opened", challenge, err)
+	}
+	other, _ := sp3.NewMailboxKey()
+	if _, err := sp3.OpenChallenge(other, sealed); err == nil {
+		t.Fatal("Challenge opened with another key")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := sp3.OpenChallenge(key, sealed); err == nil {
+		t.Fatal("Tampered challenge opened")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build nopcap
+// +build nopcap
+
+package server
+
+import (
+	"errors"
+)
+
+var errNoPcap = errors.New("Built without libpcap (nopcap)")
+
+// A PcapWriter is unavailable in builds without libpcap.
+type PcapWriter struct{}
+
+func NewPcapWriter(device string, src string, dst string, vlan int) (*PcapWriter, error) {
+	return nil, errNoPcap
+}
+
+func (p *PcapWriter) WritePacket(packet []byte) error {
+	return errNoPcap
+}
+
+func (p *PcapWriter) Close() error {
+	return nil
+}
+
+// A RoutedPcapWriter is unavailable in builds without libpcap.
+type RoutedPcapWriter struct{}
+
+func NewRoutedPcapWriter(device string, vlan int) (*RoutedPcapWriter, error) {
+	return nil, errNoPcap
+}
+
+func (p *RoutedPcapWriter) WritePacket(packet []byte) error {
+	return errNoPcap
+}
+
+func (p *RoutedPcapWriter) Close() error {
+	return nil
+}
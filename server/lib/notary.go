@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// Attestations from the future are accepted by this much, for clock skew.
+const notaryClockSkew = 5 * time.Second
+
+// checkAttestation verifies that a trusted notary recently saw destination.
+func (s *Server) checkAttestation(a *sp3.NotaryAttestation, destination string) error {
+	// Otherwise one attestation could be spent at every server.
+	if a.Server == "" || !strings.EqualFold(a.Server, s.config.ServerName) {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Attestation is for another server"}
+	}
+	if ip := net.ParseIP(a.IP); ip == nil || !ip.Equal(net.ParseIP(destination)) {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Attestation is for another address"}
+	}
+	if !s.trustedNotary(a.Key) {
+		return &sp3.Error{Code: sp3.UNTRUSTEDNOTARY, Message: "Attestation isn't from a trusted notary"}
+	}
+	if err := a.Verify(); err != nil {
+		return &sp3.Error{Code: sp3.BADATTESTATION, Message: err.Error()}
+	}
+	if age := time.Since(a.Time()); age > s.notaryMaxAge() || age < -notaryClockSkew {
+		return &sp3.Error{Code: sp3.CHALLENGEEXPIRED, Message: "Attestation is too old"}
+	}
+	return nil
+}
+
+func (s *Server) notaryMaxAge() time.Duration {
+	if s.config.NotaryMaxAge > 0 {
+		return time.Duration(s.config.NotaryMaxAge) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// spendAttestation records that a has been presented, failing if it already
+// was, so that each attestation authenticates once. Attestations are
+// remembered until they are too old to be accepted anyway.
+func (s *Server) spendAttestation(a *sp3.NotaryAttestation) error {
+	s.attestationLock.Lock()
+	defer s.attestationLock.Unlock()
+	now := time.Now()
+	for signature, expires := range s.spentAttestations {
+		if now.After(expires) {
+			delete(s.spentAttestations, signature)
+		}
+	}
+	signature := a.Challenge()
+	if _, ok := s.spentAttestations[signature]; ok {
+		return &sp3.Error{Code: sp3.CHALLENGEUNKNOWN, Message: "Attestation already used"}
+	}
+	s.spentAttestations[signature] = a.Time().Add(s.notaryMaxAge())
+	return nil
+}
+
+// trustedNotary is true for the notary keys in the config.
+func (s *Server) trustedNotary(key []byte) bool {
+	for _, trusted := range s.config.NotaryKeys {
+		if decoded, err := base64.StdEncoding.DecodeString(trusted); err == nil && string(decoded) == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotaryHandler attests to the address of each request, for the SP3 server
+// named in its server parameter, signed with key. If forwardedFor is set,
+// requests are expected through a front end which adds the client's address
+// to that header, and the last address in it is used. Attestations are only
+// readable by the requester itself, not by scripts on other origins.
+func NotaryHandler(key ed25519.PrivateKey, forwardedFor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ip net.IP
+		if forwardedFor != "" {
+			// Earlier entries come from the client, and can't be trusted.
+			hops := strings.Split(r.Header.Get(forwardedFor), ",")
+			ip = net.ParseIP(strings.TrimSpace(hops[len(hops)-1]))
+		} else {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip = net.ParseIP(host)
+		}
+		if ip == nil {
+			http.Error(w, "Client address unknown", http.StatusBadRequest)
+			return
+		}
+		server := r.URL.Query().Get("server")
+		if server == "" {
+			http.Error(w, "Server parameter missing", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// No CORS headers, so other sites' pages can't read a visitor's
+		// attestation and use it to spoof to them.
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(sp3.SignNotaryAttestation(key, server, ip, time.Now()))
+	})
+}
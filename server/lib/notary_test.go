@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+func TestNotaryHandler(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	attest := func(handler string, remote string, forwarded string) (*sp3.NotaryAttestation, int) {
+		req := httptest.NewRequest("GET", "/?server=sp3.example", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		NotaryHandler(key, handler).ServeHTTP(w, req)
+		a := &sp3.NotaryAttestation{}
+		json.Unmarshal(w.Body.Bytes(), a)
+		return a, w.Code
+	}
+
+	a, _ := attest("", "1.2.3.4:5000", "9.9.9.9")
+	if a.IP != "1.2.3.4" || a.Server != "sp3.example" || a.Verify() != nil {
+		t.Fatal("Bad attestation of the remote address", a)
+	}
+	// Behind a front end, only the address it adds is trusted.
+	if a, _ = attest("X-Forwarded-For", "10.0.0.1:5000", "9.9.9.9, 1.2.3.4"); a.IP != "1.2.3.4" {
+		t.Fatal("Forwarded address not attested", a.IP)
+	}
+	if _, code := attest("X-Forwarded-For", "10.0.0.1:5000", ""); code != 400 {
+		t.Fatal("Request without the forwarded header attested")
+	}
+	// Attestations are always for a particular server.
+	w := httptest.NewRecorder()
+	NotaryHandler(key, "").ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 400 {
+		t.Fatal("Attestation made without a server")
+	}
+	// Pages from other sites can't read a visitor's attestation.
+	w = httptest.NewRecorder()
+	NotaryHandler(key, "").ServeHTTP(w, httptest.NewRequest("GET", "/?server=sp3.example", nil))
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Attestation shared with other origins")
+	}
+}
+
+func TestCheckAttestation(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, untrusted, _ := ed25519.GenerateKey(rand.Reader)
+	conf := Config{
+		PathReflectionFile: "../pathreflection.json",
+		ServerName:         "sp3.example",
+		NotaryKeys:         []string{base64.StdEncoding.EncodeToString(public)},
+	}
+	s := NewServer(conf, NewMemoryWriter(1))
+	dest := net.ParseIP("1.2.3.4")
+
+	valid := sp3.SignNotaryAttestation(key, "sp3.example", dest, time.Now())
+	if err := s.checkAttestation(valid, "1.2.3.4"); err != nil {
+		t.Fatal("Valid attestation rejected", err)
+	}
+	// Each attestation is only good for one authentication.
+	if err := s.spendAttestation(valid); err != nil {
+		t.Fatal(err)
+	}
+	if code(s.spendAttestation(valid)) != sp3.CHALLENGEUNKNOWN {
+		t.Fatal("Attestation replayed")
+	}
+	tampered := sp3.SignNotaryAttestation(key, "sp3.example", dest, time.Now())
+	tampered.Timestamp++
+	cases := []struct {
+		attestation *sp3.NotaryAttestation
+		destination string
+		code        sp3.ErrorCode
+	}{
+		{sp3.SignNotaryAttestation(key, "sp3.example", dest, time.Now()), "5.6.7.8", sp3.DESTINATIONMISMATCH},
+		{sp3.SignNotaryAttestation(key, "other.example", dest, time.Now()), "1.2.3.4", sp3.DESTINATIONMISMATCH},
+		{sp3.SignNotaryAttestation(untrusted, "sp3.example", dest, time.Now()), "1.2.3.4", sp3.UNTRUSTEDNOTARY},
+		{tampered, "1.2.3.4", sp3.BADATTESTATION},
+		{sp3.SignNotaryAttestation(key, "sp3.example", dest, time.Now().Add(-2*time.Minute)), "1.2.3.4", sp3.CHALLENGEEXPIRED},
+		{sp3.SignNotaryAttestation(key, "sp3.example", dest, time.Now().Add(time.Minute)), "1.2.3.4", sp3.CHALLENGEEXPIRED},
+	}
+	for i, c := range cases {
+		err, ok := s.checkAttestation(c.attestation, c.destination).(*sp3.Error)
+		if !ok || err.Code != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, err)
+		}
+	}
+}
+
+func TestAttestationSpentOnIssue(t *testing.T) {
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	conf := Config{
+		PathReflectionFile: "../pathreflection.json",
+		ServerName:         "sp3.example",
+		NotaryKeys:         []string{base64.StdEncoding.EncodeToString(public)},
+	}
+	s := NewServer(conf, NewMemoryWriter(1))
+	attestation := sp3.SignNotaryAttestation(key, "sp3.example", net.ParseIP("1.2.3.4"), time.Now())
+	opts, _ := json.Marshal(attestation)
+	hello := sp3.SenderHello{DestinationAddress: "1.2.3.4", AuthenticationMethod: sp3.WEBNOTARY, AuthenticationOptions: opts}
+
+	// An attestation which can't become a challenge yet isn't used up.
+	challenge := attestation.Challenge()
+	s.reflections.issue("notary "+challenge, challenge)
+	if _, err := s.Authorize("5.6.7.8", hello); code(err) != sp3.CHALLENGEPENDING {
+		t.Fatal("Attestation issued twice at once", err)
+	}
+	s.reflections.Cancel(challenge)
+	if _, err := s.Authorize("5.6.7.8", hello); err != nil {
+		t.Fatal("Attestation spent without a challenge", err)
+	}
+	if err := s.reflections.Redeem(challenge); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authorize("5.6.7.8", hello); code(err) != sp3.CHALLENGEUNKNOWN {
+		t.Fatal("Attestation replayed", err)
+	}
+}
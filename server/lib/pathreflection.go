@@ -1,8 +1,8 @@
 /**
  * This file is part of the SP^3 server, implementing the "Path reflection" form
- * of IP verification - namely the injection of a spoofed HTTP request from the
- * SP^3 server to a remote web server that then causes a token to be sent back
- * to the client.
+ * of IP verification - namely the injection of a spoofed request from the
+ * SP^3 server to a remote web, mail or ftp server that then causes a token to
+ * be sent back to the client.
  */
 
 package server
@@ -10,13 +10,13 @@ package server
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"fmt"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"io/ioutil"
-	"log"
 	"net"
+
+	"github.com/willscott/sp3"
 )
 
 type PathReflectionState struct {
@@ -28,19 +28,55 @@ type PathReflectionState struct {
 	AcknowledgementNumber uint32
 }
 
-func getPathReflectionServers(path string) map[string]string {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Fatalf("Couldn't read path reflection config: %s", err)
-		return nil
+// Addresses which aren't globally routable unicast, from the IANA special
+// purpose registry.
+var unroutableNetworks = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4",
+	"240.0.0.0/4",
+}
+
+func routableUnicast(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
 	}
+	for _, cidr := range unroutableNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
 
-	var config map[string]string
-	if err := json.Unmarshal(data, &config); err != nil {
-		log.Fatalf("Couldn't parse path reflection config: %s", err)
-		return nil
+// Validate checks that the state describes a connection between destination
+// and a reflector listening on port, so that the server can't be made to send
+// requests from other addresses.
+func (state *PathReflectionState) Validate(destination string, port uint16) error {
+	if state.ClientIP == nil || state.ServerIP == nil {
+		return &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "Client and server addresses are required"}
+	}
+	if !state.ClientIP.Equal(net.ParseIP(destination)) {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: state.ClientIP.String() + " is not the destination " + destination}
 	}
-	return config
+	for _, ip := range []net.IP{state.ClientIP, state.ServerIP} {
+		if !routableUnicast(ip) {
+			return &sp3.Error{Code: sp3.UNROUTABLEADDRESS, Message: ip.String() + " is not a routable IPv4 unicast address"}
+		}
+	}
+	if state.ServerPort != port {
+		return &sp3.Error{Code: sp3.BADPORT, Message: fmt.Sprintf("The reflector is reached on port %d", port)}
+	}
+	if state.ClientPort < 1024 {
+		return &sp3.Error{Code: sp3.BADPORT, Message: fmt.Sprintf("Client port %d is privileged", state.ClientPort)}
+	}
+	return nil
+}
+
+// key identifies the connection the state describes.
+func (state *PathReflectionState) key() string {
+	return fmt.Sprintf("%v:%d-%v:%d", state.ClientIP, state.ClientPort, state.ServerIP, state.ServerPort)
 }
 
 func genToken() (string, error) {
@@ -61,13 +97,10 @@ func genToken() (string, error) {
 	return output, nil
 }
 
-func PathReflectionServerTrusted(conf Config, state *PathReflectionState) bool {
-	_, ok := getPathReflectionServers(conf.PathReflectionFile)[state.ServerIP.String()]
-	return ok
-}
-
-func SendPathReflectionChallenge(conf Config, state *PathReflectionState) (string, error) {
-	token, err := genToken()
+// SendPathReflectionChallenge injects a request carrying a new challenge into
+// the connection described by state. The challenge can be redeemed once.
+func (s *Server) SendPathReflectionChallenge(state *PathReflectionState) (string, error) {
+	token, err := s.reflections.Issue(state.key())
 	if err != nil {
 		return "", err
 	}
@@ -93,16 +126,18 @@ func SendPathReflectionChallenge(conf Config, state *PathReflectionState) (strin
 		DataOffset: 5,
 	}
 	tcp.SetNetworkLayerForChecksum(ip)
-	host := getPathReflectionServers(conf.PathReflectionFile)[state.ServerIP.String()]
-	request := "GET /sp3." + token + "/ HTTP/1.0\r\nHost: " + host + "\r\n\r\n"
+	profile, _ := s.reflectors.Lookup(state.ServerIP)
+	request := profile.Request(token)
 	ip.Length = 20 + 20 + uint16(len(request))
-	payload := gopacket.Payload([]byte(request))
+	payload := gopacket.Payload(request)
 	if err = gopacket.SerializeLayers(buf, opts, ip, tcp, payload); err != nil {
+		s.reflections.Cancel(token)
 		return "", err
 	}
 
 	//send.
-	if err = SpoofIPv4Message(buf.Bytes(), state.ClientIP, state.ServerIP); err != nil {
+	if err = s.spoofer.SpoofIPv4Message(buf.Bytes(), state.ClientIP, state.ServerIP, nil); err != nil {
+		s.reflections.Cancel(token)
 		return "", err
 	}
 
@@ -2,12 +2,19 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"net"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
 )
 
 func TestGenPacket(t *testing.T) {
-	TestSpoofChannel = make(chan []byte, 1)
+	writer := NewMemoryWriter(1)
 
 	state := &PathReflectionState{
 		net.IP{127, 0, 0, 1},
@@ -17,15 +24,165 @@ func TestGenPacket(t *testing.T) {
 		0,
 		0,
 	}
-	conf := Config{0, "", "", "", "../pathreflection.json"}
-	challenge, err := SendPathReflectionChallenge(conf, state)
+	conf := Config{PathReflectionFile: "../pathreflection.json"}
+	challenge, err := NewServer(conf, writer).SendPathReflectionChallenge(state)
 	if err != nil {
 		t.Fatal("Error sending challenge", err)
 	}
 
 	// Compare
-	sentPkt := <-TestSpoofChannel
+	sentPkt := <-writer.Packets
 	if !bytes.Contains(sentPkt, []byte(challenge)) {
 		t.Fatal("Challenge not in spoofed packet")
 	}
 }
+
+// reflectedToken reads the challenge from a spoofed path reflection request.
+func reflectedToken(t *testing.T, writer *MemoryWriter) string {
+	select {
+	case packet := <-writer.Packets:
+		request := string(packet)
+		start := strings.Index(request, "/sp3.")
+		end := strings.Index(request, "/ HTTP")
+		if start == -1 || end < start {
+			t.Fatal("No challenge in reflected request")
+		}
+		return request[start+5 : end]
+	case <-time.After(time.Second):
+		t.Fatal("Reflected request not sent")
+	}
+	return ""
+}
+
+func TestPathReflectionReauth(t *testing.T) {
+	writer := NewMemoryWriter(5)
+	conf := Config{PathReflectionFile: "../pathreflection.json", ReauthSeconds: 1, ReauthTimeout: 1}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, writer)))
+	defer web.Close()
+	sender, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(web.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	dest := net.ParseIP("1.2.3.4")
+	opts, _ := json.Marshal(&PathReflectionState{
+		ServerIP:   net.ParseIP("198.35.26.96"),
+		ServerPort: 80,
+		ClientIP:   dest,
+		ClientPort: 40000,
+	})
+	hello := sp3.SenderHello{
+		DestinationAddress:    "1.2.3.4",
+		AuthenticationMethod:  sp3.PATHREFLECTION,
+		AuthenticationOptions: opts,
+	}
+	authenticate := func() {
+		sender.WriteJSON(hello)
+		token := reflectedToken(t, writer)
+		sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "1.2.3.4", Challenge: token})
+	}
+	expect := func(status sp3.Status) {
+		msg := sp3.ServerMessage{}
+		sender.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if err := sender.ReadJSON(&msg); err != nil || msg.Status != status {
+			t.Fatal("Expected status", status, "got", msg.Status, err)
+		}
+	}
+	delivered := func() bool {
+		sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 5000))
+		select {
+		case <-writer.Packets:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	authenticate()
+	expect(sp3.OKAY)
+	if !delivered() {
+		t.Fatal("Authorized packet not sent")
+	}
+
+	// Without an answer to the new challenge, sending is suspended.
+	expect(sp3.REAUTHENTICATE)
+	expect(sp3.SUSPENDED)
+	if delivered() {
+		t.Fatal("Packet sent while suspended")
+	}
+
+	authenticate()
+	expect(sp3.OKAY)
+	if !delivered() {
+		t.Fatal("Packet not sent after reauthentication")
+	}
+}
+
+func TestPathReflectionValidate(t *testing.T) {
+	valid := func() *PathReflectionState {
+		return &PathReflectionState{
+			ServerIP:   net.ParseIP("198.35.26.96"),
+			ServerPort: 80,
+			ClientIP:   net.ParseIP("1.2.3.4"),
+			ClientPort: 40000,
+		}
+	}
+	if err := valid().Validate("1.2.3.4", 80); err != nil {
+		t.Fatal("Valid state rejected", err)
+	}
+
+	cases := []struct {
+		change func(*PathReflectionState)
+		code   sp3.ErrorCode
+	}{
+		{func(s *PathReflectionState) { s.ClientIP = net.ParseIP("5.6.7.8") }, sp3.DESTINATIONMISMATCH},
+		{func(s *PathReflectionState) { s.ClientIP = nil }, sp3.MALFORMEDOPTIONS},
+		{func(s *PathReflectionState) { s.ServerIP = net.ParseIP("10.0.0.1") }, sp3.UNROUTABLEADDRESS},
+		{func(s *PathReflectionState) { s.ServerIP = net.ParseIP("224.0.0.1") }, sp3.UNROUTABLEADDRESS},
+		{func(s *PathReflectionState) { s.ServerPort = 25 }, sp3.BADPORT},
+		{func(s *PathReflectionState) { s.ClientPort = 22 }, sp3.BADPORT},
+	}
+	for i, c := range cases {
+		state := valid()
+		c.change(state)
+		err, ok := state.Validate("1.2.3.4", 80).(*sp3.Error)
+		if !ok || err.Code != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, err)
+		}
+	}
+	if err, ok := valid().Validate("127.0.0.1", 80).(*sp3.Error); !ok || err.Code != sp3.DESTINATIONMISMATCH {
+		t.Fatal("State accepted for another destination", err)
+	}
+}
+
+func TestPathReflectionRejection(t *testing.T) {
+	conf := Config{PathReflectionFile: "../pathreflection.json"}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, NewMemoryWriter(1))))
+	defer web.Close()
+	sender, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(web.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	// Requests can't be sent from somewhere other than the destination.
+	opts, _ := json.Marshal(&PathReflectionState{
+		ServerIP:   net.ParseIP("198.35.26.96"),
+		ServerPort: 80,
+		ClientIP:   net.ParseIP("5.6.7.8"),
+		ClientPort: 40000,
+	})
+	sender.WriteJSON(sp3.SenderHello{
+		DestinationAddress:    "1.2.3.4",
+		AuthenticationMethod:  sp3.PATHREFLECTION,
+		AuthenticationOptions: opts,
+	})
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.UNAUTHORIZED {
+		t.Fatal("Mismatched state accepted", msg.Status, err)
+	}
+	if msg.Error == nil || msg.Error.Code != sp3.DESTINATIONMISMATCH {
+		t.Fatal("Rejection not explained", msg.Error)
+	}
+}
@@ -0,0 +1,74 @@
+//go:build !nopcap
+// +build !nopcap
+
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// A PcapWriter sends packets out of a network device through libpcap, framed
+// for the device's link type.
+type PcapWriter struct {
+	handle  *pcap.Handle
+	framing Framing
+	srcMAC  net.HardwareAddr
+	dstMAC  net.HardwareAddr
+	frame   []byte
+	sync.Mutex
+}
+
+func NewPcapWriter(device string, src string, dst string, vlan int) (*PcapWriter, error) {
+	srcMAC, err := parseMAC(src)
+	if err != nil {
+		return nil, err
+	}
+	dstMAC, err := parseMAC(dst)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := openPcapHandle(device)
+	if err != nil {
+		return nil, err
+	}
+
+	framing := Framing{LinkType: handle.LinkType(), VLAN: uint16(vlan)}
+	log.Printf("Sending on %s with %v framing", device, framing.LinkType)
+	return &PcapWriter{
+		handle:  handle,
+		framing: framing,
+		srcMAC:  srcMAC,
+		dstMAC:  dstMAC,
+	}, nil
+}
+
+func openPcapHandle(device string) (*pcap.Handle, error) {
+	handle, err := pcap.OpenLive(device, 2048, false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	// make sure the handle doesn't queue up packets and start blocking / dying
+	handle.SetBPFFilter("ip.len > 5000")
+	return handle, nil
+}
+
+func (p *PcapWriter) WritePacket(packet []byte) error {
+	// pcap copies the frame as it's sent, so the buffer can be reused.
+	p.Lock()
+	defer p.Unlock()
+	frame, err := p.framing.Append(p.frame[:0], p.srcMAC, p.dstMAC, packet)
+	if err != nil {
+		return err
+	}
+	p.frame = frame
+	return p.handle.WritePacketData(p.frame)
+}
+
+func (p *PcapWriter) Close() error {
+	p.handle.Close()
+	return nil
+}
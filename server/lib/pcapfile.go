@@ -0,0 +1,48 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A PcapFileWriter records packets to a pcap file instead of sending them,
+// for dry runs of the server.
+type PcapFileWriter struct {
+	file   *os.File
+	writer *pcapgo.Writer
+	sync.Mutex
+}
+
+func NewPcapFileWriter(path string) (*PcapFileWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := pcapgo.NewWriter(file)
+	if err = writer.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &PcapFileWriter{file: file, writer: writer}, nil
+}
+
+func (p *PcapFileWriter) WritePacket(packet []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(packet),
+		Length:        len(packet),
+	}, packet)
+}
+
+func (p *PcapFileWriter) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.file.Close()
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPcapFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.pcap")
+
+	writer, err := NewPacketWriter(Config{Backend: FileBackend, DumpFile: path})
+	if err != nil {
+		t.Fatal("Couldn't open file backend", err)
+	}
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 127, 0, 0, 1, 127, 0, 0, 1}
+	if err = writer.WritePacket(packet); err != nil {
+		t.Fatal("Couldn't record packet", err)
+	}
+	writer.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal("Dump isn't a pcap file", err)
+	}
+	if reader.LinkType() != layers.LinkTypeRaw {
+		t.Fatal("Dump should hold raw IP packets")
+	}
+	data, _, err := reader.ReadPacketData()
+	if err != nil || !bytes.Equal(data, packet) {
+		t.Fatal("Recorded packet doesn't match", err)
+	}
+}
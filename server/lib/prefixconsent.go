@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// Consent records are fetched within this long, and up to this size.
+const prefixConsentTimeout = 10 * time.Second
+const maxPrefixConsentSize = 1 << 16
+
+// The shortest prefixes an operator can consent for, since shorter reverse
+// zones are run by registries rather than operators.
+const minPrefixConsentBits4 = 8
+const minPrefixConsentBits6 = 16
+
+// resolver looks up consent records, through the configured resolver if
+// there is one.
+func (s *Server) resolver() *net.Resolver {
+	if s.config.PrefixConsentResolver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, s.config.PrefixConsentResolver)
+		},
+	}
+}
+
+// lookupPrefixConsent finds the TXT records published for prefix.
+func (s *Server) lookupPrefixConsent(prefix *net.IPNet) ([]string, error) {
+	name, err := sp3.PrefixConsentName(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prefixConsentTimeout)
+	defer cancel()
+	return s.resolver().LookupTXT(ctx, name)
+}
+
+// Consent records are only fetched from the HTTPS port, so senders can't
+// point the server at other services.
+const prefixConsentPort = "443"
+
+// fetchPrefixConsent gets the record published by host, whose address must
+// be prefix. Names are resolved, and the connection made to an address in the
+// prefix, with the certificate checked against the name.
+func (s *Server) fetchPrefixConsent(prefix *net.IPNet, host string) ([]string, error) {
+	hostname := host
+	if name, port, err := net.SplitHostPort(host); err == nil {
+		if port != prefixConsentPort {
+			return nil, &sp3.Error{Code: sp3.BADPORT, Message: "Consent is only fetched from port " + prefixConsentPort}
+		}
+		hostname = name
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prefixConsentTimeout)
+	defer cancel()
+	var addrs []net.IP
+	if ip := net.ParseIP(hostname); ip != nil {
+		addrs = []net.IP{ip}
+	} else if resolved, err := s.resolver().LookupIPAddr(ctx, hostname); err == nil {
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.IP)
+		}
+	} else {
+		return nil, err
+	}
+	var inside net.IP
+	for _, addr := range addrs {
+		if prefix.Contains(addr) {
+			inside = addr
+			break
+		}
+	}
+	if inside == nil {
+		return nil, &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: host + " isn't inside " + prefix.String()}
+	}
+
+	dial := s.consentDial
+	if dial == nil {
+		d := &net.Dialer{}
+		dial = d.DialContext
+	}
+	transport := &http.Transport{
+		TLSClientConfig: s.consentTLS,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dial(ctx, network, net.JoinHostPort(inside.String(), prefixConsentPort))
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: prefixConsentTimeout}
+	resp, err := client.Get("https://" + hostname + sp3.PrefixConsentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPrefixConsentSize))
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(body)}, nil
+}
+
+// checkPrefixConsent finds current consent from the operator of the prefix
+// in options, which must contain destination.
+func (s *Server) checkPrefixConsent(options *sp3.PrefixConsentOptions, destination string) (*sp3.PrefixConsent, error) {
+	_, prefix, err := net.ParseCIDR(options.Prefix)
+	if err != nil {
+		return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+	}
+	// Only the operator of the reverse zone consents for a whole prefix. A
+	// web server only speaks for its own address.
+	bits, size := prefix.Mask.Size()
+	if options.Host != "" && bits != size {
+		return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "A host only consents for its own address"}
+	} else if (size == 32 && bits < minPrefixConsentBits4) || (size == 128 && bits < minPrefixConsentBits6) {
+		return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "Prefix is too short"}
+	}
+	if !prefix.Contains(net.ParseIP(destination)) {
+		return nil, &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: destination + " isn't inside " + prefix.String()}
+	}
+
+	var records []string
+	if options.Host != "" {
+		// The server only connects to hosts it could send to, so it can't be
+		// used to reach into private networks.
+		if !routableUnicast(prefix.IP) {
+			return nil, &sp3.Error{Code: sp3.UNROUTABLEADDRESS, Message: prefix.IP.String() + " is not a routable IPv4 unicast address"}
+		}
+		records, err = s.fetchPrefixConsent(prefix, options.Host)
+	} else {
+		records, err = s.lookupPrefixConsent(prefix)
+	}
+	if protoErr, ok := err.(*sp3.Error); ok {
+		return nil, protoErr
+	} else if err != nil {
+		// How the lookup failed stays private, so senders can't use it to
+		// learn what is listening where.
+		log.Printf("Couldn't get consent for %v from %q: %v", prefix, options.Host, err)
+		return nil, &sp3.Error{Code: sp3.NOCONSENTRECORD, Message: "No consent published for " + prefix.String()}
+	}
+
+	expired := false
+	for _, record := range records {
+		consent := &sp3.PrefixConsent{}
+		if json.Unmarshal([]byte(record), consent) != nil {
+			continue
+		}
+		if _, published, err := net.ParseCIDR(consent.Prefix); err != nil || published.String() != prefix.String() {
+			continue
+		}
+		if consent.Scope.Expiry.IsZero() || time.Now().After(consent.Scope.Expiry) {
+			expired = true
+			continue
+		}
+		return consent, nil
+	}
+	if expired {
+		return nil, &sp3.Error{Code: sp3.CHALLENGEEXPIRED, Message: "Consent for " + prefix.String() + " has expired"}
+	}
+	return nil, &sp3.Error{Code: sp3.NOCONSENTRECORD, Message: "No consent published for " + prefix.String()}
+}
+
+// prefixGrant is the grant for a prefix's consent. Senders to any address in
+// the prefix share it while the published scope stays the same.
+func (s *Server) prefixGrant(consent *sp3.PrefixConsent) (*Grant, error) {
+	key, err := json.Marshal(consent)
+	if err != nil {
+		return nil, err
+	}
+	return s.sharedGrant("prefix "+string(key), consent.Scope)
+}
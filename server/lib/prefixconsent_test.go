@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/gorilla/websocket"
+
+	"github.com/willscott/sp3"
+)
+
+// txtServer stands in for DNS, answering TXT queries from records.
+func txtServer(t *testing.T, records map[string]string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query := &layers.DNS{}
+			if query.DecodeFromBytes(buf[0:n], gopacket.NilDecodeFeedback) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			question := query.Questions[0]
+			query.QR, query.AA, query.RA = true, true, true
+			query.ResponseCode = layers.DNSResponseCodeNXDomain
+			if record, ok := records[strings.TrimSuffix(string(question.Name), ".")]; ok {
+				query.ResponseCode = layers.DNSResponseCodeNoErr
+				if question.Type == layers.DNSTypeTXT {
+					query.Answers = []layers.DNSResourceRecord{{
+						Name:  question.Name,
+						Type:  layers.DNSTypeTXT,
+						Class: layers.DNSClassIN,
+						TTL:   60,
+						TXTs:  [][]byte{[]byte(record)},
+					}}
+				}
+			}
+			out := gopacket.NewSerializeBuffer()
+			if query.SerializeTo(out, gopacket.SerializeOptions{FixLengths: true}) == nil {
+				conn.WriteToUDP(out.Bytes(), from)
+			}
+		}
+	}()
+	return conn
+}
+
+func consentRecord(prefix string, scope sp3.ConsentScope) string {
+	data, _ := json.Marshal(sp3.PrefixConsent{Prefix: prefix, Scope: scope})
+	return string(data)
+}
+
+func TestPrefixConsentName(t *testing.T) {
+	for prefix, name := range map[string]string{
+		"192.0.2.0/24":    "_sp3-consent.2.0.192.in-addr.arpa",
+		"198.51.100.0/22": "_sp3-consent.51.198.in-addr.arpa",
+		"2001:db8::/32":   "_sp3-consent.8.b.d.0.1.0.0.2.ip6.arpa",
+	} {
+		_, network, _ := net.ParseCIDR(prefix)
+		if got, err := sp3.PrefixConsentName(network); err != nil || got != name {
+			t.Fatal("Bad record name for", prefix, got, err)
+		}
+	}
+}
+
+func TestDNSPrefixConsent(t *testing.T) {
+	later := time.Now().Add(time.Minute)
+	dns := txtServer(t, map[string]string{
+		"_sp3-consent.2.0.192.in-addr.arpa":    consentRecord("192.0.2.0/24", sp3.ConsentScope{Ports: []uint16{5000}, Expiry: later}),
+		"_sp3-consent.100.51.198.in-addr.arpa": consentRecord("198.51.100.0/24", sp3.ConsentScope{Expiry: time.Now().Add(-time.Minute)}),
+		"_sp3-consent.113.0.203.in-addr.arpa":  consentRecord("192.0.2.0/24", sp3.ConsentScope{Expiry: later}),
+	})
+	defer dns.Close()
+	writer := NewMemoryWriter(1)
+	conf := Config{PathReflectionFile: "../pathreflection.json", PrefixConsentResolver: dns.LocalAddr().String()}
+	s := NewServer(conf, writer)
+
+	check := func(prefix string, destination string) sp3.ErrorCode {
+		_, err := s.checkPrefixConsent(&sp3.PrefixConsentOptions{Prefix: prefix}, destination)
+		return code(err)
+	}
+	if got := check("192.0.2.0/24", "192.0.2.77"); got != "" {
+		t.Fatal("Published consent not found", got)
+	}
+	cases := []struct {
+		prefix, destination string
+		code                sp3.ErrorCode
+	}{
+		{"192.0.2.0/24", "192.0.3.1", sp3.DESTINATIONMISMATCH},
+		{"198.51.100.0/24", "198.51.100.1", sp3.CHALLENGEEXPIRED},
+		{"203.0.113.0/24", "203.0.113.1", sp3.NOCONSENTRECORD}, // The record is for another prefix
+		{"10.1.0.0/16", "10.1.0.1", sp3.NOCONSENTRECORD},
+		{"0.0.0.0/0", "10.1.0.1", sp3.MALFORMEDOPTIONS},
+	}
+	for i, c := range cases {
+		if got := check(c.prefix, c.destination); got != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, got)
+		}
+	}
+
+	// Senders to any address in the prefix are authorized within the scope.
+	web := httptest.NewServer(SocketHandler(s))
+	defer web.Close()
+	sender, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(web.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	opts, _ := json.Marshal(sp3.PrefixConsentOptions{Prefix: "192.0.2.0/24"})
+	sender.WriteJSON(sp3.SenderHello{DestinationAddress: "192.0.2.77", AuthenticationMethod: sp3.PREFIXCONSENT, AuthenticationOptions: opts})
+	sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "192.0.2.77", Challenge: "192.0.2.0/24"})
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.OKAY {
+		t.Fatal("Prefix consent not accepted", msg, err)
+	}
+	dest := net.ParseIP("192.0.2.77")
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 6000))
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 5000))
+	select {
+	case packet := <-writer.Packets:
+		if port, _ := destinationPort(layers.IPProtocolUDP, packet[20:]); port != 5000 {
+			t.Fatal("Packet outside the scope sent", port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Packet within the scope not sent")
+	}
+}
+
+func TestHTTPSPrefixConsent(t *testing.T) {
+	record := consentRecord("8.8.8.8/32", sp3.ConsentScope{Expiry: time.Now().Add(time.Minute)})
+	web := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != sp3.PrefixConsentPath {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, record)
+	}))
+	defer web.Close()
+
+	// The host is reached at its public address, which the test server
+	// stands in for, and its certificate is for example.com.
+	s := NewServer(Config{PathReflectionFile: "../pathreflection.json"}, NewMemoryWriter(1))
+	trusted := web.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	trusted.ServerName = "example.com"
+	s.consentTLS = trusted
+	var dialed []string
+	s.consentDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		d := net.Dialer{}
+		return d.DialContext(ctx, network, web.Listener.Addr().String())
+	}
+	check := func(prefix, host, destination string) error {
+		_, err := s.checkPrefixConsent(&sp3.PrefixConsentOptions{Prefix: prefix, Host: host}, destination)
+		return err
+	}
+	if err := check("8.8.8.8/32", "8.8.8.8", "8.8.8.8"); err != nil {
+		t.Fatal("Published consent not found", err)
+	}
+	if len(dialed) != 1 || dialed[0] != "8.8.8.8:443" {
+		t.Fatal("Consent not fetched from the host's HTTPS port", dialed)
+	}
+
+	dialed = nil
+	cases := []struct {
+		prefix, host, destination string
+		code                      sp3.ErrorCode
+	}{
+		// A host only consents for its own address, not its neighbors'.
+		{"8.8.0.0/16", "8.8.8.8", "8.8.8.9", sp3.MALFORMEDOPTIONS},
+		{"9.9.9.9/32", "8.8.8.8", "9.9.9.9", sp3.DESTINATIONMISMATCH},
+		{"8.8.8.8/32", "8.8.8.8:8443", "8.8.8.8", sp3.BADPORT},
+		{"127.0.0.1/32", "127.0.0.1", "127.0.0.1", sp3.UNROUTABLEADDRESS},
+		{"10.0.0.9/32", "10.0.0.9", "10.0.0.9", sp3.UNROUTABLEADDRESS},
+	}
+	for i, c := range cases {
+		if got := code(check(c.prefix, c.host, c.destination)); got != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, got)
+		}
+	}
+	if len(dialed) != 0 {
+		t.Fatal("Rejected hosts were contacted", dialed)
+	}
+
+	// Without trusting its certificate, the host isn't believed. Senders
+	// can't tell that from the host not answering.
+	s.consentTLS = nil
+	untrusted := check("8.8.8.8/32", "8.8.8.8", "8.8.8.8")
+	if code(untrusted) != sp3.NOCONSENTRECORD {
+		t.Fatal("Consent accepted from an untrusted host", untrusted)
+	}
+	s.consentTLS = trusted
+	s.consentDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	unreachable := check("8.8.8.8/32", "8.8.8.8", "8.8.8.8")
+	if code(unreachable) != sp3.NOCONSENTRECORD || unreachable.Error() != untrusted.Error() {
+		t.Fatal("Failures distinguishable", unreachable, untrusted)
+	}
+}
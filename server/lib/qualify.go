@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// Responses are read up to this size, since larger ones only matter in being
+// too large.
+const maxQualifyResponse = 1 << 20
+
+// The most a first segment carries, with a typical MSS.
+const firstSegmentSize = 1460
+
+// A Qualification is what trying a candidate path reflector found.
+type Qualification struct {
+	IP           string
+	Profile      sp3.ReflectorProfile
+	Reflected    bool // The challenge came back in the response
+	FirstSegment bool // The challenge came back in the first segment of the response
+	ResponseSize int
+}
+
+// QualifyReflector sends the request of profile, carrying a new challenge, to
+// ip over an ordinary TCP connection, and records how it is answered.
+func QualifyReflector(ip string, profile sp3.ReflectorProfile, timeout time.Duration) (*Qualification, error) {
+	if err := profile.Check(); err != nil {
+		return nil, err
+	}
+	token, err := genToken()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(profile.ServerPort())))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	q := &Qualification{IP: ip, Profile: profile}
+	response := []byte{}
+	buf := make([]byte, 65536)
+	greeting := 0
+	for profile.Greeting() && greeting == 0 {
+		// The client waits for all of the greeting before the request is
+		// injected, so it is sent here at the same point.
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, buf[:n]...)
+		greeting = profile.GreetingEnd(response)
+	}
+	if _, err = conn.Write(profile.Request(token)); err != nil {
+		return nil, err
+	}
+
+	for len(response) < maxQualifyResponse {
+		n, err := conn.Read(buf)
+		response = append(response, buf[:n]...)
+		if n > 0 && len(response)-greeting == n {
+			// The client may only get the first segment of the response, as
+			// it can't acknowledge the rest.
+			first := response[greeting:]
+			if len(first) > firstSegmentSize {
+				first = first[:firstSegmentSize]
+			}
+			found, ok := profile.FindToken(first)
+			q.FirstSegment = ok && found == token
+		}
+		if found, ok := profile.FindToken(response[greeting:]); ok && found == token && profile.Greeting() {
+			// Line based servers wait for the next command after replying.
+			break
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// Servers which keep the connection open end the response by
+			// going quiet.
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && len(response) > 0 {
+				break
+			}
+			return nil, err
+		}
+	}
+	found, ok := profile.FindToken(response[greeting:])
+	q.Reflected = ok && found == token
+	q.ResponseSize = len(response)
+	return q, nil
+}
+
+// Problem explains why a reflector shouldn't be used, or is nil if it can
+// be. Responses larger than maxSize would flood clients.
+func (q *Qualification) Problem(maxSize int) error {
+	if !q.Reflected {
+		return errors.New("Challenge not reflected")
+	}
+	if !q.FirstSegment {
+		return errors.New("Challenge not in the first segment of the response")
+	}
+	if maxSize > 0 && q.ResponseSize > maxSize {
+		return fmt.Errorf("Response of %d bytes is larger than %d", q.ResponseSize, maxSize)
+	}
+	return nil
+}
+
+// WriteReflectorFile saves reflectors in the format of pathreflection.json,
+// after checking that the server would accept them.
+func WriteReflectorFile(path string, reflectors map[string]sp3.ReflectorProfile) error {
+	for ip, profile := range reflectors {
+		if net.ParseIP(ip) == nil {
+			return errors.New("Reflector " + ip + " is not an IP address")
+		}
+		if err := profile.Check(); err != nil {
+			return errors.New("Reflector " + ip + ": " + err.Error())
+		}
+	}
+	data, err := json.MarshalIndent(reflectors, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+func localProfile(t *testing.T, addr net.Addr) sp3.ReflectorProfile {
+	_, port, _ := net.SplitHostPort(addr.String())
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp3.ReflectorProfile{Host: "localhost", Port: uint16(portNum)}
+}
+
+func TestQualifyReflector(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/sp3.") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "%s was not found", r.URL.Path)
+			return
+		}
+		fmt.Fprintf(w, "Welcome")
+	}))
+	defer web.Close()
+	profile := localProfile(t, web.Listener.Addr())
+
+	q, err := QualifyReflector("127.0.0.1", profile, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Reflected || !q.FirstSegment || q.ResponseSize == 0 {
+		t.Fatal("Reflecting server not qualified", q)
+	}
+	if err := q.Problem(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Problem(10); err == nil {
+		t.Fatal("Large response accepted")
+	}
+
+	profile.Path = "/other/{token}"
+	if q, err = QualifyReflector("127.0.0.1", profile, time.Second); err != nil || q.Reflected {
+		t.Fatal("Path reflected by a server which doesn't echo it", err)
+	}
+	if q.Problem(0) == nil {
+		t.Fatal("Unreflected challenge accepted")
+	}
+}
+
+func TestQualifyFirstSegment(t *testing.T) {
+	// A server which only echoes the path after a delay, in a later segment.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, 1024)
+		n, _ := conn.Read(request)
+		conn.Write([]byte("HTTP/1.0 404 Not Found\r\n\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte(strings.Fields(string(request[:n]))[1]))
+	}()
+
+	q, err := QualifyReflector("127.0.0.1", localProfile(t, listener.Addr()), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Reflected || q.FirstSegment {
+		t.Fatal("Late reflection not detected", q)
+	}
+}
+
+// lineServer greets clients, then answers each command with reply, in which
+// %s is replaced by the argument.
+func lineServer(t *testing.T, greeting, reply string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greetingLines := strings.Split(greeting, "\r\n")
+				for _, line := range greetingLines[:len(greetingLines)-1] {
+					fmt.Fprintf(conn, "%s\r\n", line)
+					// Like many MTAs, turn away clients which talk before the
+					// greeting is over.
+					time.Sleep(20 * time.Millisecond)
+					conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+					if n, _ := conn.Read(make([]byte, 1)); n > 0 {
+						fmt.Fprint(conn, "554 No early talkers\r\n")
+						return
+					}
+					conn.SetReadDeadline(time.Time{})
+				}
+				fmt.Fprintf(conn, "%s\r\n", greetingLines[len(greetingLines)-1])
+				lines := bufio.NewScanner(conn)
+				for lines.Scan() {
+					fields := strings.Fields(lines.Text())
+					if len(fields) < 2 {
+						return
+					}
+					fmt.Fprint(conn, strings.Replace(reply, "%s", fields[1], -1)+"\r\n")
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestQualifyLineProtocols(t *testing.T) {
+	smtp := lineServer(t, "220 mail.example ESMTP", "250-mail.example Hello %s\r\n250 HELP")
+	defer smtp.Close()
+	profile := localProfile(t, smtp.Addr())
+	profile.Host = ""
+	profile.Protocol = sp3.SMTP
+	q, err := QualifyReflector("127.0.0.1", profile, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Problem(0); err != nil {
+		t.Fatal("SMTP reflector not qualified", err)
+	}
+
+	// The request waits for all of a greeting, even over several segments.
+	multiline := lineServer(t, "220-mail.example ESMTP\r\n220 Ready", "250 mail.example Hello %s")
+	defer multiline.Close()
+	profile = localProfile(t, multiline.Addr())
+	profile.Host = ""
+	profile.Protocol = sp3.SMTP
+	if q, err = QualifyReflector("127.0.0.1", profile, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Problem(0); err != nil {
+		t.Fatal("SMTP reflector with a multi-line greeting not qualified", err)
+	}
+
+	ftp := lineServer(t, "220 FTP ready", "331 Please specify the password.")
+	defer ftp.Close()
+	profile = localProfile(t, ftp.Addr())
+	profile.Host = ""
+	profile.Protocol = sp3.FTP
+	if q, err = QualifyReflector("127.0.0.1", profile, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if q.Reflected {
+		t.Fatal("FTP server which doesn't echo the user qualified")
+	}
+}
+
+func TestWriteReflectorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pathreflection.json")
+
+	if WriteReflectorFile(path, map[string]sp3.ReflectorProfile{"example.com": {}}) == nil {
+		t.Fatal("Reflector without an IP written")
+	}
+	if WriteReflectorFile(path, map[string]sp3.ReflectorProfile{"1.2.3.4": {Path: "/static"}}) == nil {
+		t.Fatal("Unusable profile written")
+	}
+	written := map[string]sp3.ReflectorProfile{"1.2.3.4": {Host: "one.example", Port: 8080}}
+	if err := WriteReflectorFile(path, written); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := NewReflectorRegistry(path)
+	if err != nil {
+		t.Fatal("Written file not loaded", err)
+	}
+	if profile, ok := registry.Lookup(net.ParseIP("1.2.3.4")); !ok || profile.ServerPort() != 8080 {
+		t.Fatal("Profile not kept", profile)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A RateLimiter keeps a token bucket for each key, such as a sender or
+// reflector address. It is safe for concurrent use.
+type RateLimiter struct {
+	rate      float64 // Tokens added per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows perMinute events for each key, and up to burst of
+// them at once.
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      perMinute / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token for key. If none is available, it returns how long
+// until one will be.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	b := l.refill(key, time.Now())
+	if wait := l.wait(b); wait > 0 {
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// allowAll takes a token from each limiter for the key at the same index,
+// only if all of them have one. Otherwise it takes none, and returns the
+// index of the first limiter without a token, and how long until it will
+// have one. Limiters are locked in order, so callers must pass them in the
+// same order, each at most once.
+func allowAll(limiters []*RateLimiter, keys []string) (int, time.Duration) {
+	now := time.Now()
+	buckets := make([]*bucket, len(limiters))
+	for i, l := range limiters {
+		l.Lock()
+		defer l.Unlock()
+		buckets[i] = l.refill(keys[i], now)
+	}
+	for i, l := range limiters {
+		if wait := l.wait(buckets[i]); wait > 0 {
+			return i, wait
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return -1, 0
+}
+
+// refill brings the bucket of key up to now. The limiter must be locked.
+func (l *RateLimiter) refill(key string, now time.Time) *bucket {
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// wait is how long until b has a token, 0 if it has one now.
+func (l *RateLimiter) wait(b *bucket) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	if l.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets which have refilled, so idle keys don't accumulate.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
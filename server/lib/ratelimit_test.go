@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(600, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatal("Burst not allowed")
+		}
+	}
+	ok, wait := limiter.Allow("a")
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatal("Limit not enforced", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Fatal("Keys not limited separately")
+	}
+	time.Sleep(wait + 10*time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatal("Bucket didn't refill")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	senders, destinations := NewRateLimiter(600, 1), NewRateLimiter(600, 1)
+	destinations.Allow("1.2.3.4")
+	if blocked, wait := allowAll([]*RateLimiter{senders, destinations}, []string{"5.6.7.8", "1.2.3.4"}); blocked != 1 || wait <= 0 {
+		t.Fatal("Exhausted limiter not reported", blocked, wait)
+	}
+	// The sender's token wasn't spent on the rejected challenge.
+	if blocked, _ := allowAll([]*RateLimiter{senders, destinations}, []string{"5.6.7.8", "9.9.9.9"}); blocked != -1 {
+		t.Fatal("Token spent on a rejected challenge", blocked)
+	}
+	if blocked, _ := allowAll([]*RateLimiter{senders, destinations}, []string{"5.6.7.8", "8.8.8.8"}); blocked != 0 {
+		t.Fatal("Sender not limited", blocked)
+	}
+}
+
+func TestSenderLimitKey(t *testing.T) {
+	if senderLimitKey("2001:db8::1") != "2001:db8::/64" || senderLimitKey("2001:db8::ffff:1") != "2001:db8::/64" {
+		t.Fatal("IPv6 senders not limited by /64", senderLimitKey("2001:db8::1"))
+	}
+	if senderLimitKey("2001:db8:0:1::1") == senderLimitKey("2001:db8::1") {
+		t.Fatal("Different /64s limited together")
+	}
+	if senderLimitKey("1.2.3.4") != "1.2.3.4" {
+		t.Fatal("IPv4 sender key changed", senderLimitKey("1.2.3.4"))
+	}
+}
+
+func TestChallengeRateLimit(t *testing.T) {
+	conf := Config{DestinationChallengeRate: 1, ChallengeBurst: 1}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, NewMemoryWriter(1))))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{}})
+	time.Sleep(50 * time.Millisecond)
+
+	sender := authorizeSender(t, url, client)
+	defer sender.Close()
+
+	// The next sender would push a second challenge to the client too soon.
+	sender, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.WriteJSON(sp3.SenderHello{DestinationAddress: "127.0.0.1"})
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.UNAUTHORIZED {
+		t.Fatal("Challenge not limited", msg.Status, err)
+	}
+	if msg.Error == nil || msg.Error.Code != sp3.RATELIMITED || msg.Error.RetryAfter <= 0 {
+		t.Fatal("Limit not explained", msg.Error)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IPV6_HDRINCL from linux/in6.h, which the syscall package doesn't export.
+const ipv6HdrIncl = 36
+
+// A RawSocketWriter sends packets through raw IPv4 and IPv6 sockets in
+// header-included mode, leaving routing and link-layer framing to the kernel.
+type RawSocketWriter struct {
+	fd4 int
+	fd6 int
+}
+
+func NewRawSocketWriter() (*RawSocketWriter, error) {
+	fd4, err := openRawSocket(syscall.AF_INET, syscall.IPPROTO_IP, syscall.IP_HDRINCL)
+	if err != nil {
+		return nil, err
+	}
+	fd6, err := openRawSocket(syscall.AF_INET6, syscall.IPPROTO_IPV6, ipv6HdrIncl)
+	if err == syscall.EAFNOSUPPORT {
+		log.Println("IPv6 unavailable, raw socket backend will only send IPv4")
+	} else if err != nil {
+		syscall.Close(fd4)
+		return nil, err
+	}
+	return &RawSocketWriter{fd4, fd6}, nil
+}
+
+func openRawSocket(family int, level int, hdrincl int) (int, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err == syscall.EPERM || err == syscall.EACCES {
+		return -1, errors.New("Raw sockets need CAP_NET_RAW: " + err.Error())
+	} else if err != nil {
+		return -1, err
+	}
+	if err = syscall.SetsockoptInt(fd, level, hdrincl, 1); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (r *RawSocketWriter) WritePacket(packet []byte) error {
+	if version := ipVersion(packet); version == 4 {
+		to := &syscall.SockaddrInet4{}
+		copy(to.Addr[:], packet[16:20])
+		return syscall.Sendto(r.fd4, packet, 0, to)
+	} else if version == 6 && r.fd6 >= 0 {
+		to := &syscall.SockaddrInet6{}
+		copy(to.Addr[:], packet[24:40])
+		return syscall.Sendto(r.fd6, packet, 0, to)
+	}
+	return errNotIP
+}
+
+func (r *RawSocketWriter) Close() error {
+	err := syscall.Close(r.fd4)
+	if r.fd6 >= 0 {
+		if err6 := syscall.Close(r.fd6); err == nil {
+			err = err6
+		}
+	}
+	return err
+}
+
+// An mmsghdr, as taken by sendmmsg(2).
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// WritePackets sends a batch of packets with sendmmsg(2). Since each family
+// has its own socket, the batch is sent in runs of the same IP version.
+func (r *RawSocketWriter) WritePackets(packets [][]byte) (int, error) {
+	sent := 0
+	for sent < len(packets) {
+		version := ipVersion(packets[sent])
+		end := sent + 1
+		for end < len(packets) && ipVersion(packets[end]) == version {
+			end++
+		}
+
+		var n int
+		var err error
+		if version == 4 {
+			n, err = sendmmsg(r.fd4, packets[sent:end], 4)
+		} else if version == 6 && r.fd6 >= 0 {
+			n, err = sendmmsg(r.fd6, packets[sent:end], 6)
+		} else {
+			err = errNotIP
+		}
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+func sendmmsg(fd int, packets [][]byte, version int) (int, error) {
+	msgs := make([]mmsghdr, len(packets))
+	iovs := make([]unix.Iovec, len(packets))
+	addrs4 := make([]unix.RawSockaddrInet4, len(packets))
+	addrs6 := make([]unix.RawSockaddrInet6, len(packets))
+	for i, packet := range packets {
+		iovs[i].Base = &packet[0]
+		iovs[i].SetLen(len(packet))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.SetIovlen(1)
+		if version == 4 {
+			addrs4[i].Family = unix.AF_INET
+			copy(addrs4[i].Addr[:], packet[16:20])
+			msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&addrs4[i]))
+			msgs[i].hdr.Namelen = unix.SizeofSockaddrInet4
+		} else {
+			addrs6[i].Family = unix.AF_INET6
+			copy(addrs6[i].Addr[:], packet[24:40])
+			msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&addrs6[i]))
+			msgs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		}
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd),
+			uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		} else if errno != 0 {
+			return sent, errno
+		}
+		sent += int(n)
+	}
+	runtime.KeepAlive(iovs)
+	runtime.KeepAlive(addrs4)
+	runtime.KeepAlive(addrs6)
+	return sent, nil
+}
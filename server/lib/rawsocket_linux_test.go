@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRawSocketWriter(t *testing.T) {
+	writer, err := NewRawSocketWriter()
+	if err != nil {
+		t.Skip("Raw sockets unavailable:", err)
+	}
+	defer writer.Close()
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+
+	if err = writer.WritePacket(udpPacket(t, net.IPv4(127, 0, 0, 1), port)); err != nil {
+		t.Fatal("Couldn't send packet", err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	recvd := make([]byte, 2048)
+	n, from, err := listener.ReadFromUDP(recvd)
+	if err != nil {
+		t.Fatal("Packet not received", err)
+	}
+	if string(recvd[0:n]) != "Hello World!" || !from.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatal("Received wrong packet from", from)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+)
+
+var errNoRawSocket = errors.New("Raw socket backend is only supported on linux")
+
+// A RawSocketWriter is unavailable on this platform.
+type RawSocketWriter struct{}
+
+func NewRawSocketWriter() (*RawSocketWriter, error) {
+	return nil, errNoRawSocket
+}
+
+func (r *RawSocketWriter) WritePacket(packet []byte) error {
+	return errNoRawSocket
+}
+
+func (r *RawSocketWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+// Reflectors which fail this many probes in a row are taken out of rotation,
+// until a probe succeeds again.
+const reflectorFailureLimit = 2
+
+const probeTimeout = 10 * time.Second
+
+// A ReflectorRegistry holds the path reflection servers trusted by the server,
+// as a map from IP address to the profile for using it. It is loaded from a file once,
+// and reloaded when the file changes or the process gets SIGHUP. If a reload
+// fails, the last good copy is kept.
+type ReflectorRegistry struct {
+	path string
+	// Probe checks that a reflector still echoes the request path. It
+	// defaults to ProbeReflector.
+	Probe func(ip string, profile sp3.ReflectorProfile) error
+
+	reflectors map[string]sp3.ReflectorProfile
+	failures   map[string]int
+	modTime    time.Time
+	size       int64
+	sync.RWMutex
+}
+
+// NewReflectorRegistry loads the reflectors in path. A registry is returned
+// even if they can't be loaded, so that a later reload can succeed.
+func NewReflectorRegistry(path string) (*ReflectorRegistry, error) {
+	r := &ReflectorRegistry{
+		path:       path,
+		Probe:      ProbeReflector,
+		reflectors: make(map[string]sp3.ReflectorProfile),
+		failures:   make(map[string]int),
+	}
+	return r, r.Load()
+}
+
+// Load reads the reflector file, replacing the current reflectors if it can
+// be parsed.
+func (r *ReflectorRegistry) Load() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]sp3.ReflectorProfile)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	// Reflectors are kept by the canonical form of their address, which is
+	// how they are looked up.
+	reflectors := make(map[string]sp3.ReflectorProfile, len(entries))
+	for entry, profile := range entries {
+		parsed := net.ParseIP(entry)
+		if parsed == nil {
+			return errors.New("Reflector " + entry + " is not an IP address")
+		}
+		if err := profile.Check(); err != nil {
+			return errors.New("Reflector " + entry + ": " + err.Error())
+		}
+		ip := parsed.String()
+		if _, ok := reflectors[ip]; ok {
+			return errors.New("Reflector " + ip + " is listed more than once")
+		}
+		reflectors[ip] = profile
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	// Failures only count against the reflector as it was probed.
+	for ip := range r.failures {
+		if profile, ok := reflectors[ip]; !ok || !reflect.DeepEqual(profile, r.reflectors[ip]) {
+			delete(r.failures, ip)
+		}
+	}
+	r.reflectors = reflectors
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	return nil
+}
+
+// changed is true if the file looks different from when it was loaded.
+func (r *ReflectorRegistry) changed() bool {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return !info.ModTime().Equal(r.modTime) || info.Size() != r.size
+}
+
+// Lookup finds the profile of a reflector, if it is trusted and healthy.
+func (r *ReflectorRegistry) Lookup(ip net.IP) (sp3.ReflectorProfile, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	profile, ok := r.reflectors[ip.String()]
+	if !ok || r.failures[ip.String()] >= reflectorFailureLimit {
+		return sp3.ReflectorProfile{}, false
+	}
+	return profile, true
+}
+
+// Healthy returns the reflectors currently in rotation.
+func (r *ReflectorRegistry) Healthy() map[string]sp3.ReflectorProfile {
+	r.RLock()
+	defer r.RUnlock()
+	healthy := make(map[string]sp3.ReflectorProfile)
+	for ip, profile := range r.reflectors {
+		if r.failures[ip] < reflectorFailureLimit {
+			healthy[ip] = profile
+		}
+	}
+	return healthy
+}
+
+// ProbeAll probes every reflector, updating which are in rotation.
+func (r *ReflectorRegistry) ProbeAll() {
+	r.RLock()
+	reflectors := make(map[string]sp3.ReflectorProfile)
+	for ip, profile := range r.reflectors {
+		reflectors[ip] = profile
+	}
+	r.RUnlock()
+
+	results := make(map[string]error)
+	for ip, profile := range reflectors {
+		results[ip] = r.Probe(ip, profile)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for ip, err := range results {
+		// Results for reflectors changed by a reload meanwhile are stale.
+		if current, ok := r.reflectors[ip]; !ok || !reflect.DeepEqual(current, reflectors[ip]) {
+			continue
+		}
+		if err == nil {
+			if r.failures[ip] >= reflectorFailureLimit {
+				log.Printf("Reflector %s is back in rotation.", ip)
+			}
+			delete(r.failures, ip)
+			continue
+		}
+		r.failures[ip]++
+		if r.failures[ip] == reflectorFailureLimit {
+			log.Printf("Reflector %s taken out of rotation: %v", ip, err)
+		}
+	}
+}
+
+// Watch reloads the reflectors when their file changes or on SIGHUP, checking
+// for changes every poll, and probes them every probe if it is non-zero.
+// Watching continues until the returned function is called.
+func (r *ReflectorRegistry) Watch(poll time.Duration, probe time.Duration) func() {
+	done := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reload := func() {
+		if err := r.Load(); err != nil {
+			log.Printf("Couldn't reload path reflectors, keeping the last good copy: %v", err)
+		}
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		pollTicker := time.NewTicker(poll)
+		defer pollTicker.Stop()
+		// Probes may be slow, so they run apart from reloads, and a tick is
+		// skipped while the last run is still going.
+		probing := make(chan struct{}, 1)
+		probeAll := func() {
+			select {
+			case probing <- struct{}{}:
+				go func() {
+					r.ProbeAll()
+					<-probing
+				}()
+			default:
+				log.Printf("Skipping reflector probes, the last run hasn't finished.")
+			}
+		}
+		var probeTick <-chan time.Time
+		if probe > 0 {
+			probeTicker := time.NewTicker(probe)
+			defer probeTicker.Stop()
+			probeTick = probeTicker.C
+			probeAll()
+		}
+		for {
+			select {
+			case <-hup:
+				reload()
+			case <-pollTicker.C:
+				if r.changed() {
+					reload()
+				}
+			case <-probeTick:
+				probeAll()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ServeHTTP publishes the healthy reflectors, for clients to choose from.
+func (r *ReflectorRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Healthy())
+}
+
+// ProbeReflector checks that the reflector at ip echoes a challenge sent with
+// its profile, as path reflection relies on. The request is sent over an
+// ordinary connection, rather than injected.
+func ProbeReflector(ip string, profile sp3.ReflectorProfile) error {
+	q, err := QualifyReflector(ip, profile, probeTimeout)
+	if err != nil {
+		return err
+	}
+	if !q.Reflected {
+		return errors.New("Challenge not reflected by " + ip)
+	}
+	return nil
+}
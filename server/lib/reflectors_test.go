@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/willscott/sp3"
+)
+
+func TestReflectorRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pathreflection.json")
+
+	if _, err := NewReflectorRegistry(path); err == nil {
+		t.Fatal("Missing file loaded")
+	}
+	ioutil.WriteFile(path, []byte(`{"1.2.3.4": "one.example"}`), 0600)
+	registry, err := NewReflectorRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile, ok := registry.Lookup(net.ParseIP("1.2.3.4")); !ok || profile.Host != "one.example" {
+		t.Fatal("Reflector not loaded")
+	}
+
+	// A bad file leaves the last good copy in place.
+	ioutil.WriteFile(path, []byte(`{"1.2.3.4": `), 0600)
+	if err := registry.Load(); err == nil {
+		t.Fatal("Bad file loaded")
+	}
+	if _, ok := registry.Lookup(net.ParseIP("1.2.3.4")); !ok {
+		t.Fatal("Last good copy not kept")
+	}
+
+	// Addresses needn't be written in canonical form.
+	ioutil.WriteFile(path, []byte(`{"2001:DB8:0::1": "six.example", "::ffff:1.2.3.4": "one.example"}`), 0600)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.Lookup(net.ParseIP("2001:db8::1")); !ok {
+		t.Fatal("Non-canonical IPv6 reflector not found")
+	}
+	if _, ok := registry.Lookup(net.ParseIP("1.2.3.4")); !ok {
+		t.Fatal("IPv4-mapped reflector not found")
+	}
+	ioutil.WriteFile(path, []byte(`{"1.2.3.4": "one.example", "::ffff:1.2.3.4": "two.example"}`), 0600)
+	if err := registry.Load(); err == nil {
+		t.Fatal("Duplicate reflector loaded")
+	}
+
+	// Changes are picked up while watching.
+	stop := registry.Watch(10*time.Millisecond, 0)
+	defer stop()
+	ioutil.WriteFile(path, []byte(`{"1.2.3.4": "one.example", "5.6.7.8": "two.example"}`), 0600)
+	for i := 0; ; i++ {
+		if _, ok := registry.Lookup(net.ParseIP("5.6.7.8")); ok {
+			break
+		} else if i == 100 {
+			t.Fatal("Changed file not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReflectorProbes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pathreflection.json")
+	ioutil.WriteFile(path, []byte(`{"1.2.3.4": "one.example", "5.6.7.8": "two.example"}`), 0600)
+	registry, _ := NewReflectorRegistry(path)
+
+	broken := true
+	registry.Probe = func(ip string, profile sp3.ReflectorProfile) error {
+		if ip == "5.6.7.8" && broken {
+			return errors.New("Path not reflected")
+		}
+		return nil
+	}
+	published := func() map[string]sp3.ReflectorProfile {
+		w := httptest.NewRecorder()
+		registry.ServeHTTP(w, httptest.NewRequest("GET", "/pathreflection.json", nil))
+		reflectors := map[string]sp3.ReflectorProfile{}
+		json.Unmarshal(w.Body.Bytes(), &reflectors)
+		return reflectors
+	}
+
+	// One failure is tolerated.
+	registry.ProbeAll()
+	if _, ok := registry.Lookup(net.ParseIP("5.6.7.8")); !ok {
+		t.Fatal("Reflector removed after one failure")
+	}
+	registry.ProbeAll()
+	if _, ok := registry.Lookup(net.ParseIP("5.6.7.8")); ok {
+		t.Fatal("Failing reflector still in rotation")
+	}
+	if reflectors := published(); len(reflectors) != 1 || reflectors["1.2.3.4"].Host != "one.example" {
+		t.Fatal("Failing reflector published", reflectors)
+	}
+
+	broken = false
+	registry.ProbeAll()
+	if len(published()) != 2 {
+		t.Fatal("Recovered reflector not back in rotation")
+	}
+
+	// Probes of reflectors which are reloaded meanwhile don't count.
+	probing, release := make(chan struct{}), make(chan struct{})
+	registry.Probe = func(ip string, profile sp3.ReflectorProfile) error {
+		if ip == "5.6.7.8" {
+			probing <- struct{}{}
+			<-release
+			return errors.New("Path not reflected")
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		registry.ProbeAll()
+		close(done)
+	}()
+	<-probing
+	ioutil.WriteFile(path, []byte(`{"1.2.3.4": "one.example"}`), 0600)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+	registry.RLock()
+	defer registry.RUnlock()
+	if _, ok := registry.failures["5.6.7.8"]; ok {
+		t.Fatal("Failure counted for a removed reflector")
+	}
+}
+
+func TestReflectorProfile(t *testing.T) {
+	profiles := map[string]sp3.ReflectorProfile{}
+	err := json.Unmarshal([]byte(`{
+		"1.2.3.4": "one.example",
+		"5.6.7.8": {"Host": "two.example", "Port": 8080, "Path": "/search?q={token}",
+			"Version": "HTTP/1.1", "Headers": {"Accept": "*/*"},
+			"Extraction": "Location: [^\\r]*[?&]t=([A-Za-z0-9]+)"}
+	}`), &profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profiles["1.2.3.4"].Host != "one.example" || profiles["1.2.3.4"].ServerPort() != 80 {
+		t.Fatal("Host name not read as a default profile", profiles["1.2.3.4"])
+	}
+	if string(profiles["1.2.3.4"].Request("abc")) != "GET /sp3.abc/ HTTP/1.0\r\nHost: one.example\r\n\r\n" {
+		t.Fatal("Default request changed")
+	}
+
+	custom := profiles["5.6.7.8"]
+	if err := custom.Check(); err != nil {
+		t.Fatal(err)
+	}
+	request := string(custom.Request("abc"))
+	if request != "GET /search?q=abc HTTP/1.1\r\nHost: two.example\r\nAccept: */*\r\nConnection: close\r\n\r\n" {
+		t.Fatal("Bad request from profile", request)
+	}
+	if (sp3.ReflectorProfile{Version: "HTTP/1.1", Headers: map[string]string{"host": "two.example"}}).Check() != nil {
+		t.Fatal("Host header not accepted for HTTP/1.1")
+	}
+	response := []byte("HTTP/1.1 302 Found\r\nLocation: /results?x=sp3.nope&t=abc\r\n\r\n")
+	if token, ok := custom.FindToken(response); !ok || token != "abc" {
+		t.Fatal("Token not found in header", token)
+	}
+
+	for _, bad := range []sp3.ReflectorProfile{
+		{Path: "/static"},
+		{Path: "/{token}", Extraction: "no group"},
+		{Path: "/{token}", Extraction: "("},
+		{Headers: map[string]string{"X": "a\r\nInjected: b"}},
+		{Version: "HTTP/1.1"},
+	} {
+		if bad.Check() == nil {
+			t.Fatal("Bad profile accepted", bad)
+		}
+	}
+}
+
+func TestLineProtocolProfiles(t *testing.T) {
+	profiles := map[string]sp3.ReflectorProfile{}
+	err := json.Unmarshal([]byte(`{
+		"1.2.3.4": {"Protocol": "smtp"},
+		"5.6.7.8": {"Protocol": "ftp", "Port": 2121}
+	}`), &profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtp, ftp := profiles["1.2.3.4"], profiles["5.6.7.8"]
+	if smtp.Check() != nil || ftp.Check() != nil {
+		t.Fatal("Default line protocol profiles rejected")
+	}
+	if smtp.ServerPort() != 25 || !smtp.Greeting() || ftp.ServerPort() != 2121 {
+		t.Fatal("Protocol defaults not used")
+	}
+	if string(smtp.Request("abc")) != "EHLO sp3.abc\r\n" || string(ftp.Request("abc")) != "USER sp3.abc\r\n" {
+		t.Fatal("Bad command", string(smtp.Request("abc")), string(ftp.Request("abc")))
+	}
+	response := []byte("220 mail.example ESMTP\r\n250-mail.example Hello sp3.abc [192.0.2.1]\r\n250 HELP\r\n")
+	if token, ok := smtp.FindToken(response); !ok || token != "abc" {
+		t.Fatal("Token not found in EHLO reply", token)
+	}
+	if smtp.GreetingEnd(response) != 24 || smtp.GreetingEnd([]byte("220-mail.example\r\n220 ")) != 0 {
+		t.Fatal("Greeting not measured")
+	}
+	if ftp.GreetingEnd([]byte("220-Welcome\r\n220 FTP ready\r\nUSER")) != 28 {
+		t.Fatal("Multi-line greeting not measured")
+	}
+
+	for _, bad := range []sp3.ReflectorProfile{
+		{Protocol: "gopher"},
+		{Protocol: sp3.SMTP, Path: "example.com"},
+		{Protocol: sp3.SMTP, Host: "example.com"},
+		{Protocol: sp3.FTP, Path: "{token}\r\nDELE x"},
+		{Protocol: sp3.FTP, Method: "USER x"},
+	} {
+		if bad.Check() == nil {
+			t.Fatal("Bad profile accepted", bad)
+		}
+	}
+}
+
+func TestProbeReflector(t *testing.T) {
+	// Echo the query in the body, but not the path.
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No results for %s", r.URL.Query().Get("q"))
+	}))
+	defer web.Close()
+	_, port, _ := net.SplitHostPort(web.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	profile := sp3.ReflectorProfile{Port: uint16(portNum), Path: "/?q=sp3.{token}"}
+	if err := ProbeReflector("127.0.0.1", profile); err != nil {
+		t.Fatal("Working reflector failed probe", err)
+	}
+	profile.Path = "/sp3.{token}/"
+	if err := ProbeReflector("127.0.0.1", profile); err == nil {
+		t.Fatal("Reflector which doesn't echo the path passed probe")
+	}
+}
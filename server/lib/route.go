@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// A Route is an entry from the kernel routing table.
+type Route struct {
+	Dst      *net.IPNet
+	Gateway  net.IP // nil for on-link routes
+	Iface    int
+	Priority int
+}
+
+// A Neighbor is an entry from the kernel ARP / NDP cache.
+type Neighbor struct {
+	IP    net.IP
+	MAC   net.HardwareAddr
+	Iface int
+}
+
+// A NextHop is where a packet to a destination should be sent.
+type NextHop struct {
+	Iface  net.Interface
+	SrcMAC net.HardwareAddr // nil on interfaces without link-layer addresses
+	DstMAC net.HardwareAddr
+}
+
+// A RouteTable chooses the egress interface and next hop for destinations,
+// from a snapshot of the kernel routing table and neighbor cache.
+type RouteTable struct {
+	device    string
+	routes    []Route
+	neighbors map[int]map[string]net.HardwareAddr
+	ifaces    map[int]net.Interface
+	sync.RWMutex
+}
+
+// NewRouteTable creates an empty table. If device is set, only routes out of
+// that interface will be used.
+func NewRouteTable(device string) *RouteTable {
+	return &RouteTable{device: device}
+}
+
+// Update replaces the contents of the table.
+func (t *RouteTable) Update(routes []Route, neighbors []Neighbor, ifaces []net.Interface) {
+	byIndex := make(map[int]net.Interface)
+	for _, iface := range ifaces {
+		byIndex[iface.Index] = iface
+	}
+	neighborMap := make(map[int]map[string]net.HardwareAddr)
+	for _, n := range neighbors {
+		if _, ok := neighborMap[n.Iface]; !ok {
+			neighborMap[n.Iface] = make(map[string]net.HardwareAddr)
+		}
+		neighborMap[n.Iface][n.IP.String()] = n.MAC
+	}
+	usable := make([]Route, 0, len(routes))
+	for _, r := range routes {
+		if iface, ok := byIndex[r.Iface]; ok && (t.device == "" || iface.Name == t.device) {
+			usable = append(usable, r)
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.routes = usable
+	t.neighbors = neighborMap
+	t.ifaces = byIndex
+}
+
+// Lookup finds the next hop for a destination, by longest prefix match.
+func (t *RouteTable) Lookup(dst net.IP) (NextHop, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	var best *Route
+	bestLen := -1
+	for i, r := range t.routes {
+		if !r.Dst.Contains(dst) {
+			continue
+		}
+		ones, _ := r.Dst.Mask.Size()
+		if ones > bestLen || (ones == bestLen && r.Priority < best.Priority) {
+			best = &t.routes[i]
+			bestLen = ones
+		}
+	}
+	if best == nil {
+		return NextHop{}, errors.New("No route to " + dst.String())
+	}
+	return t.resolve(best, dst)
+}
+
+func (t *RouteTable) resolve(r *Route, dst net.IP) (NextHop, error) {
+	iface := t.ifaces[r.Iface]
+	hop := NextHop{Iface: iface}
+	if len(iface.HardwareAddr) == 0 {
+		return hop, nil
+	}
+	gw := r.Gateway
+	if gw == nil {
+		gw = dst
+	}
+	mac, ok := t.neighbors[r.Iface][gw.String()]
+	if !ok {
+		return hop, errors.New("No neighbor entry for " + gw.String() + " on " + iface.Name)
+	}
+	hop.SrcMAC = iface.HardwareAddr
+	hop.DstMAC = mac
+	return hop, nil
+}
+
+// Resolvable checks that at least one route has a known next hop, so that a
+// server using the table can send somewhere. On-link routes over Ethernet
+// only resolve per destination, so they don't count.
+func (t *RouteTable) Resolvable() error {
+	t.RLock()
+	defer t.RUnlock()
+	for i, r := range t.routes {
+		if r.Gateway == nil && len(t.ifaces[r.Iface].HardwareAddr) > 0 {
+			continue
+		}
+		if _, err := t.resolve(&t.routes[i], r.Gateway); err == nil {
+			return nil
+		}
+	}
+	return errors.New("No route with a resolvable next hop")
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Refresh loads the current routing table and neighbor cache from the kernel.
+func (t *RouteTable) Refresh() error {
+	routes, err := readRoutes()
+	if err != nil {
+		return err
+	}
+	neighbors, err := readNeighbors()
+	if err != nil {
+		return err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	t.Update(routes, neighbors, ifaces)
+	return nil
+}
+
+// Watch refreshes the table whenever the kernel announces a change to routes,
+// neighbors or links, until the returned function is called.
+func (t *RouteTable) Watch() (func(), error) {
+	// The socket is non-blocking and handed to the runtime poller, so that
+	// closing it wakes the read.
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	groups := uint32(unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE | unix.RTMGRP_NEIGH | unix.RTMGRP_LINK)
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	socket := os.NewFile(uintptr(fd), "netlink")
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			if _, err := socket.Read(buf); err != nil {
+				close(changes)
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	go func() {
+		for range changes {
+			// Let a burst of announcements settle before reloading.
+			time.Sleep(100 * time.Millisecond)
+			if err := t.Refresh(); err != nil {
+				log.Println("Couldn't refresh routes:", err)
+			}
+		}
+	}()
+	return func() { socket.Close() }, nil
+}
+
+func readRoutes() ([]Route, error) {
+	msgs, err := netlinkDump(syscall.RTM_GETROUTE)
+	if err != nil {
+		return nil, err
+	}
+	routes := []Route{}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		rtm := (*unix.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if rtm.Type != unix.RTN_UNICAST {
+			continue
+		}
+		attrs := parseAttrs(m.Data[unix.SizeofRtMsg:])
+		if table, ok := attrs[unix.RTA_TABLE]; ok && len(table) == 4 {
+			if nativeUint32(table) != unix.RT_TABLE_MAIN {
+				continue
+			}
+		} else if rtm.Table != unix.RT_TABLE_MAIN {
+			continue
+		}
+
+		size := net.IPv4len
+		if rtm.Family == syscall.AF_INET6 {
+			size = net.IPv6len
+		}
+		r := Route{Dst: &net.IPNet{
+			IP:   make(net.IP, size),
+			Mask: net.CIDRMask(int(rtm.Dst_len), size*8),
+		}}
+		if dst, ok := attrs[unix.RTA_DST]; ok && len(dst) == size {
+			copy(r.Dst.IP, dst)
+		}
+		if gw, ok := attrs[unix.RTA_GATEWAY]; ok && len(gw) == size {
+			r.Gateway = net.IP(gw)
+		}
+		if oif, ok := attrs[unix.RTA_OIF]; ok && len(oif) == 4 {
+			r.Iface = int(nativeUint32(oif))
+		}
+		if prio, ok := attrs[unix.RTA_PRIORITY]; ok && len(prio) == 4 {
+			r.Priority = int(nativeUint32(prio))
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func readNeighbors() ([]Neighbor, error) {
+	msgs, err := netlinkDump(syscall.RTM_GETNEIGH)
+	if err != nil {
+		return nil, err
+	}
+	usable := uint16(unix.NUD_REACHABLE | unix.NUD_STALE | unix.NUD_DELAY | unix.NUD_PROBE | unix.NUD_PERMANENT)
+	neighbors := []Neighbor{}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		ndm := (*unix.NdMsg)(unsafe.Pointer(&m.Data[0]))
+		if ndm.State&usable == 0 {
+			continue
+		}
+		attrs := parseAttrs(m.Data[unix.SizeofNdMsg:])
+		ip, mac := attrs[unix.NDA_DST], attrs[unix.NDA_LLADDR]
+		if len(ip) == 0 || len(mac) == 0 {
+			continue
+		}
+		neighbors = append(neighbors, Neighbor{
+			IP:    net.IP(ip),
+			MAC:   net.HardwareAddr(mac),
+			Iface: int(ndm.Ifindex),
+		})
+	}
+	return neighbors, nil
+}
+
+func netlinkDump(request int) ([]syscall.NetlinkMessage, error) {
+	rib, err := syscall.NetlinkRIB(request, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	return syscall.ParseNetlinkMessage(rib)
+}
+
+// parseAttrs splits netlink route attributes by type.
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofRtAttr {
+		length := int(nativeUint16(b[0:2]))
+		if length < unix.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs[nativeUint16(b[2:4])] = b[unix.SizeofRtAttr:length]
+		aligned := (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+// Netlink integers are in host byte order.
+func nativeUint16(b []byte) uint16 {
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func nativeUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRouteWatchStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	stop, err := NewRouteTable("").Watch()
+	if err != nil {
+		t.Skip("Netlink unavailable:", err)
+	}
+	stop()
+	// Stopping wakes the blocked read, so the watch goroutines end.
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatal("Watch goroutines still running", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+)
+
+var errNoRoutes = errors.New("Reading routes is only supported on linux")
+
+func (t *RouteTable) Refresh() error {
+	return errNoRoutes
+}
+
+func (t *RouteTable) Watch() (func(), error) {
+	return nil, errNoRoutes
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func testRouteTable(device string) *RouteTable {
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	_, lanNet, _ := net.ParseCIDR("192.168.1.0/24")
+	_, tunNet, _ := net.ParseCIDR("10.8.0.0/16")
+	_, v6Net, _ := net.ParseCIDR("::/0")
+	eth0MAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	eth1MAC, _ := net.ParseMAC("02:00:00:00:00:02")
+	gwMAC, _ := net.ParseMAC("02:00:00:00:00:fe")
+	hostMAC, _ := net.ParseMAC("02:00:00:00:00:0a")
+
+	table := NewRouteTable(device)
+	table.Update([]Route{
+		{Dst: defaultNet, Gateway: net.IP{192, 168, 1, 1}, Iface: 2, Priority: 100},
+		{Dst: defaultNet, Gateway: net.IP{172, 16, 0, 1}, Iface: 3, Priority: 200},
+		{Dst: lanNet, Iface: 2},
+		{Dst: tunNet, Iface: 4},
+		{Dst: v6Net, Gateway: net.ParseIP("fe80::1"), Iface: 3},
+	}, []Neighbor{
+		{IP: net.IP{192, 168, 1, 1}, MAC: gwMAC, Iface: 2},
+		{IP: net.IP{192, 168, 1, 10}, MAC: hostMAC, Iface: 2},
+		{IP: net.IP{172, 16, 0, 1}, MAC: gwMAC, Iface: 3},
+	}, []net.Interface{
+		{Index: 2, Name: "eth0", HardwareAddr: eth0MAC},
+		{Index: 3, Name: "eth1", HardwareAddr: eth1MAC},
+		{Index: 4, Name: "tun0"},
+	})
+	return table
+}
+
+func TestRouteLookup(t *testing.T) {
+	table := testRouteTable("")
+	if err := table.Resolvable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Default route prefers the lower priority.
+	hop, err := table.Lookup(net.ParseIP("8.8.8.8"))
+	if err != nil || hop.Iface.Name != "eth0" || hop.DstMAC.String() != "02:00:00:00:00:fe" {
+		t.Fatal("Wrong default route", hop, err)
+	}
+	// On-link destinations use their own neighbor entry.
+	hop, err = table.Lookup(net.ParseIP("192.168.1.10"))
+	if err != nil || hop.DstMAC.String() != "02:00:00:00:00:0a" {
+		t.Fatal("Wrong on-link next hop", hop, err)
+	}
+	if _, err = table.Lookup(net.ParseIP("192.168.1.11")); err == nil {
+		t.Fatal("On-link destination without a neighbor entry resolved")
+	}
+	// Tunnels don't need link addresses.
+	hop, err = table.Lookup(net.ParseIP("10.8.1.1"))
+	if err != nil || hop.Iface.Name != "tun0" || hop.DstMAC != nil {
+		t.Fatal("Wrong tunnel route", hop, err)
+	}
+	if _, err = table.Lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Fatal("IPv6 gateway without a neighbor entry resolved")
+	}
+}
+
+func TestRouteDevice(t *testing.T) {
+	table := testRouteTable("eth1")
+	hop, err := table.Lookup(net.ParseIP("8.8.8.8"))
+	if err != nil || hop.Iface.Name != "eth1" {
+		t.Fatal("Device restriction not applied", hop, err)
+	}
+	hop, err = table.Lookup(net.ParseIP("10.8.1.1"))
+	if err != nil || hop.Iface.Name != "eth1" {
+		t.Fatal("Route on another device used", hop, err)
+	}
+
+	table = testRouteTable("tun1")
+	if table.Resolvable() == nil {
+		t.Fatal("Table without routes is resolvable")
+	}
+}
+
+func TestStaticMACsNeedDevice(t *testing.T) {
+	_, err := NewPacketWriter(Config{Src: "02:00:00:00:00:01", Dst: "02:00:00:00:00:02"})
+	if err != errNoDevice {
+		t.Fatal("Static MACs accepted without a device", err)
+	}
+}
+
+func TestParseMAC(t *testing.T) {
+	for _, mac := range []string{"02:00:00:00:00:01", "02-00-00-00-00-01", "020000000001"} {
+		if addr, err := parseMAC(mac); err != nil || addr.String() != "02:00:00:00:00:01" {
+			t.Fatal("Ethernet address not read", mac, addr, err)
+		}
+	}
+	for _, mac := range []string{"", "02:00:00:00:01", "0200000000", "02:00:00:00:00:00:00:01", "zz"} {
+		if _, err := parseMAC(mac); err == nil {
+			t.Fatal("Bad Ethernet address accepted", mac)
+		}
+	}
+}
+
+func TestRouteRefresh(t *testing.T) {
+	table := NewRouteTable("")
+	if err := table.Refresh(); err != nil {
+		t.Skip("Can't read kernel routes:", err)
+	}
+	if len(table.routes) == 0 {
+		t.Log("No routes in kernel table")
+	}
+}
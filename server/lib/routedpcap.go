@@ -0,0 +1,89 @@
+//go:build !nopcap
+// +build !nopcap
+
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// A RoutedPcapWriter sends packets through libpcap, choosing the interface
+// and next hop MAC for each destination from the kernel routing table and
+// neighbor cache, which it keeps up to date as they change.
+type RoutedPcapWriter struct {
+	routes  *RouteTable
+	stop    func()
+	vlan    uint16
+	handles map[string]*pcap.Handle
+	frame   []byte
+	sync.Mutex
+}
+
+// NewRoutedPcapWriter fails unless some route has a resolvable next hop. If
+// device is set, only routes out of that interface are used. A non-zero vlan
+// tags packets sent on Ethernet interfaces.
+func NewRoutedPcapWriter(device string, vlan int) (*RoutedPcapWriter, error) {
+	routes := NewRouteTable(device)
+	if err := routes.Refresh(); err != nil {
+		return nil, err
+	}
+	if err := routes.Resolvable(); err != nil {
+		return nil, err
+	}
+	stop, err := routes.Watch()
+	if err != nil {
+		return nil, err
+	}
+	return &RoutedPcapWriter{
+		routes:  routes,
+		stop:    stop,
+		vlan:    uint16(vlan),
+		handles: make(map[string]*pcap.Handle),
+	}, nil
+}
+
+func (p *RoutedPcapWriter) WritePacket(packet []byte) error {
+	var dst net.IP
+	switch ipVersion(packet) {
+	case 4:
+		dst = net.IP(packet[16:20])
+	case 6:
+		dst = net.IP(packet[24:40])
+	default:
+		return errNotIP
+	}
+	hop, err := p.routes.Lookup(dst)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	handle, ok := p.handles[hop.Iface.Name]
+	if !ok {
+		if handle, err = openPcapHandle(hop.Iface.Name); err != nil {
+			return err
+		}
+		p.handles[hop.Iface.Name] = handle
+	}
+	framing := Framing{LinkType: handle.LinkType(), VLAN: p.vlan}
+	frame, err := framing.Append(p.frame[:0], hop.SrcMAC, hop.DstMAC, packet)
+	if err != nil {
+		return err
+	}
+	p.frame = frame
+	return handle.WritePacketData(p.frame)
+}
+
+func (p *RoutedPcapWriter) Close() error {
+	p.stop()
+	p.Lock()
+	defer p.Unlock()
+	for _, handle := range p.handles {
+		handle.Close()
+	}
+	return nil
+}
@@ -1,13 +1,19 @@
 package server
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
@@ -15,72 +21,415 @@ import (
 )
 
 type Server struct {
-	sync.Mutex
-	upgrader     websocket.Upgrader
-	webServer    http.Server
-	config       Config
-	destinations map[string]*websocket.Conn
-	clientHosts  map[string]*websocket.Conn
+	upgrader   websocket.Upgrader
+	webServer  *http.Server
+	config     Config
+	spoofer    *Spoofer
+	sessions   *SessionRegistry
+	reflectors *ReflectorRegistry
+	// Path reflection challenges, one per reflected connection.
+	reflections *ChallengeTracker
+	// Limits on challenges, so authentication can't be used to flood anyone.
+	senderLimit      *RateLimiter
+	destinationLimit *RateLimiter
+	reflectorLimit   *RateLimiter
+	registrar        ed25519.PrivateKey // Signs consent key registrations, if set
+	sharedGrants     map[string]*Grant  // Grants of consent tokens and prefixes in use
+	grantLock        sync.Mutex
+	consentTLS       *tls.Config // For fetching prefix consent, the default if nil
+	// Dials hosts for prefix consent, a net.Dialer if nil.
+	consentDial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Notary attestations already presented, until they expire.
+	spentAttestations map[string]time.Time
+	attestationLock   sync.Mutex
+	mailbox           *Mailbox   // Senders waiting for relayed WEBSOCKET challenges
+	approvals         *Approvals // Senders waiting for clients to approve them
 }
 
 type Config struct {
-	Port               int
-	Device             string
-	Src                string
-	Dst                string
-	PathReflectionFile string
+	Port                  int
+	Device                string
+	Src                   string
+	Dst                   string
+	VLAN                  int // 802.1Q tag for packets sent on Ethernet links
+	PathReflectionFile    string
+	Backend               string   // Egress backend, "pcap" (default), "raw" or "file"
+	DumpFile              string   // Output of the "file" backend
+	BatchSize             int      // Packets to send at once, if more than 1
+	BatchFlushMillis      int      // Longest a packet waits for its batch to fill
+	ReauthSeconds         int      // How often non-websocket senders are challenged again, if set
+	ReauthTimeout         int      // Seconds a sender has to answer, 30 if unset
+	ChallengeTimeout      int      // Seconds a path reflection challenge can be answered in, 30 if unset
+	ReflectorProbeSeconds int      // How often path reflectors are checked, if set
+	TrafficNoticeSeconds  int      // How often consenting clients are told about their traffic, 5 if unset
+	DNSResolvers          []string // Resolvers trusted for DNS reflection
+	DNSReflectionZone     string   // Zone of DNS reflection queries, sp3.invalid if unset
+	StunServers           []string // STUN servers trusted for STUN injection, as ip:port, port 3478 if left out
+	ServerName            string   // Host name senders reach the server by, which notary attestations must be for
+	NotaryKeys            []string // Base64 ed25519 public keys of trusted web notaries
+	NotaryMaxAge          int      // Seconds a notary attestation is good for, 60 if unset
+
+	// Consent tokens are signed by keys configured here, as a map from each
+	// address to its base64 ed25519 public key, or registered with a
+	// registrar. The server registers keys itself if it has a RegistrarKeyFile,
+	// holding a base64 ed25519 seed, and trusts registrations signed by the
+	// RegistrarKeys of other servers.
+	ConsentKeys       map[string]string
+	RegistrarKeyFile  string
+	RegistrarKeys     []string
+	RegistrationHours int // How long registrations last, 168 if unset
+
+	PrefixConsentResolver string // DNS server for prefix consent records, host:port, the system's if unset
+
+	// Challenges per minute allowed for each sender, destination and
+	// reflector, 6, 6 and 60 if unset, with up to ChallengeBurst (3) at once.
+	SenderChallengeRate      float64
+	DestinationChallengeRate float64
+	ReflectorChallengeRate   float64
+	ChallengeBurst           int
 }
 
-func (s Server) Authorize(hello sp3.SenderHello) (challenge string, err error) {
+// Authorize starts authenticating a sender, from the host sender. It returns
+// the challenges the sender may answer with, and the grant each one would
+// authorize the sender under. Methods which don't rely on a consenting client
+// have a nil grant.
+func (s *Server) Authorize(sender string, hello sp3.SenderHello) (challenges map[string]*Grant, err error) {
+	// Neither limit is spent unless both allow the challenge.
+	senderKey := senderLimitKey(sender)
+	if blocked, wait := allowAll([]*RateLimiter{s.senderLimit, s.destinationLimit}, []string{senderKey, hello.DestinationAddress}); blocked == 0 {
+		return nil, limitError("sender", senderKey, wait)
+	} else if blocked == 1 {
+		return nil, limitError("destination", hello.DestinationAddress, wait)
+	}
 	if hello.AuthenticationMethod == sp3.PATHREFLECTION {
 		state := &PathReflectionState{}
 		if err = json.Unmarshal(hello.AuthenticationOptions, state); err != nil {
-			return "", err
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		profile, trusted := s.reflectors.Lookup(state.ServerIP)
+		if err = state.Validate(hello.DestinationAddress, profile.ServerPort()); err != nil {
+			return nil, err
+		}
+		if !trusted {
+			return nil, &sp3.Error{Code: sp3.UNTRUSTEDREFLECTOR, Message: state.ServerIP.String() + " is not a trusted reflector"}
+		}
+		if err = limit(s.reflectorLimit, "reflector", state.ServerIP.String()); err != nil {
+			return nil, err
+		}
+		challenge, err := s.SendPathReflectionChallenge(state)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]*Grant{challenge: nil}, nil
+	} else if hello.AuthenticationMethod == sp3.DNSREFLECTION {
+		state := &DNSReflectionState{}
+		if err = json.Unmarshal(hello.AuthenticationOptions, state); err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
 		}
-		if !PathReflectionServerTrusted(s.config, state) {
-			return "", errors.New("Untrusted Server")
+		if err = state.Validate(hello.DestinationAddress); err != nil {
+			return nil, err
 		}
-		return SendPathReflectionChallenge(s.config, state)
+		if !s.trustedResolver(state.ResolverIP) {
+			return nil, &sp3.Error{Code: sp3.UNTRUSTEDREFLECTOR, Message: state.ResolverIP.String() + " is not a trusted resolver"}
+		}
+		if err = limit(s.reflectorLimit, "reflector", state.ResolverIP.String()); err != nil {
+			return nil, err
+		}
+		challenge, err := s.SendDNSReflectionChallenge(state)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]*Grant{challenge: nil}, nil
+	} else if hello.AuthenticationMethod == sp3.STUNINJECTION {
+		state := &StunInjectionState{}
+		if err = json.Unmarshal(hello.AuthenticationOptions, state); err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		if err = state.Validate(hello.DestinationAddress); err != nil {
+			return nil, err
+		}
+		if !s.trustedStunServer(state.ServerIP, state.ServerPort) {
+			return nil, &sp3.Error{Code: sp3.UNTRUSTEDREFLECTOR, Message: fmt.Sprintf("%v:%d is not a trusted STUN server", state.ServerIP, state.ServerPort)}
+		}
+		if err = limit(s.reflectorLimit, "reflector", state.ServerIP.String()); err != nil {
+			return nil, err
+		}
+		challenge, err := s.SendStunChallenge(state)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]*Grant{challenge: nil}, nil
+	} else if hello.AuthenticationMethod == sp3.WEBNOTARY {
+		// The attestation is the proof, and its signature the challenge.
+		attestation := &sp3.NotaryAttestation{}
+		if err = json.Unmarshal(hello.AuthenticationOptions, attestation); err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		if err = s.checkAttestation(attestation, hello.DestinationAddress); err != nil {
+			return nil, err
+		}
+		// The attestation is only used up once it has become a challenge.
+		challenge := attestation.Challenge()
+		if err = s.reflections.issue("notary "+challenge, challenge); err != nil {
+			return nil, err
+		}
+		if err = s.spendAttestation(attestation); err != nil {
+			s.reflections.Cancel(challenge)
+			return nil, err
+		}
+		return map[string]*Grant{challenge: nil}, nil
+	} else if hello.AuthenticationMethod == sp3.CONSENTTOKEN {
+		// The token is the consent, and its signature the challenge.
+		token := &sp3.ConsentToken{}
+		if err = json.Unmarshal(hello.AuthenticationOptions, token); err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		if err = s.checkConsentToken(token, hello.DestinationAddress); err != nil {
+			return nil, err
+		}
+		grant, err := s.tokenGrant(token)
+		if err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		return map[string]*Grant{token.Challenge(): grant}, nil
+	} else if hello.AuthenticationMethod == sp3.PREFIXCONSENT {
+		// The operator's published record is the consent, and the prefix the
+		// challenge.
+		options := &sp3.PrefixConsentOptions{}
+		if err = json.Unmarshal(hello.AuthenticationOptions, options); err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		consent, err := s.checkPrefixConsent(options, hello.DestinationAddress)
+		if err != nil {
+			return nil, err
+		}
+		grant, err := s.prefixGrant(consent)
+		if err != nil {
+			return nil, &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}
+		}
+		return map[string]*Grant{options.Prefix: grant}, nil
 	} else if hello.AuthenticationMethod == sp3.WEBSOCKET {
-		if val, ok := s.clientHosts[hello.DestinationAddress]; ok {
-			resp := sp3.ServerMessage{
-				Status:    sp3.OKAY,
-				Challenge: uuid.New(),
+		// Each consenting client gets its own challenge, so the answer shows
+		// whose consent the sender is acting under.
+		if len(hello.PublicKey) != 0 {
+			if err = checkRelayKey(hello.PublicKey); err != nil {
+				return nil, err
+			}
+		}
+		clients := s.sessions.ConsentingClients(hello.DestinationAddress)
+		offers := make(chan challengeOffer, len(clients))
+		for _, client := range clients {
+			go func(client *Session) {
+				offers <- s.offerChallenge(client, sender, hello)
+			}(client)
+		}
+		challenges = make(map[string]*Grant)
+		var denial error
+		for range clients {
+			offer := <-offers
+			if offer.err != nil {
+				denial = offer.err
+			} else if offer.challenge != "" {
+				challenges[offer.challenge] = offer.grant
 			}
-			dat, _ := json.Marshal(resp)
-			if err = val.WriteMessage(websocket.TextMessage, dat); err != nil {
-				return "", err
+		}
+		if len(challenges) == 0 {
+			if denial != nil {
+				return nil, denial
 			}
-			return resp.Challenge, nil
+			return nil, errors.New("No consenting connection from requested destination.")
 		}
-
-		return "", errors.New("No active connection from requested destination.")
+		return challenges, nil
 	} else {
-		return "", errors.New("UNSUPPORTED")
+		return nil, errors.New("UNSUPPORTED")
 	}
 }
 
-func (s Server) Cleanup(remoteAddr string) {
-	log.Printf("Closed connection from %s.", remoteAddr)
-	if conn, ok := s.destinations[remoteAddr]; ok {
-		conn.Close()
-		delete(s.destinations, remoteAddr)
-		if addrHost, _, err := net.SplitHostPort(remoteAddr); err == nil {
-			if cc, ok := s.clientHosts[addrHost]; ok && cc == conn {
-				delete(s.clientHosts, addrHost)
+// A challengeOffer is the challenge a consenting client was sent for a
+// sender, and the grant it authorizes, or why the client wasn't asked.
+type challengeOffer struct {
+	challenge string
+	grant     *Grant
+	err       error
+}
 
-				// See if there's another connection from the same address to promote.
-				for addr, otherConn := range s.destinations {
-					if destAddr, _, err := net.SplitHostPort(addr); err == nil && destAddr == addrHost {
-						s.clientHosts[destAddr] = otherConn
-						break
-					}
-				}
+// offerChallenge sends client a challenge for sender, once the client
+// approves it if it approves senders.
+func (s *Server) offerChallenge(client *Session, sender string, hello sp3.SenderHello) challengeOffer {
+	grant := client.Consent()
+	if grant.Revoked() || grant.Expired() {
+		return challengeOffer{}
+	}
+	if grant.Approve {
+		approved, err := s.approve(grant, sender, hello)
+		if err != nil {
+			log.Println("Sender", sender, "not approved by", client.RemoteAddr, err)
+			return challengeOffer{err: err}
+		}
+		grant = approved
+	}
+	challenge := uuid.New()
+	resp := sp3.ServerMessage{Status: sp3.OKAY, Challenge: challenge}
+	if len(hello.PublicKey) > 0 {
+		// The client only relays the challenge, so it never crosses the
+		// client's connection in the clear.
+		sealed, err := sp3.SealChallenge(hello.PublicKey, challenge)
+		if err != nil {
+			return challengeOffer{err: &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: err.Error()}}
+		}
+		resp = sp3.ServerMessage{Status: sp3.OKAY, PublicKey: hello.PublicKey, Sealed: sealed}
+	}
+	if err := client.Send(resp); err != nil {
+		log.Println("Couldn't send challenge to", client.RemoteAddr, err)
+		return challengeOffer{}
+	}
+	return challengeOffer{challenge: challenge, grant: grant}
+}
+
+// limit takes a token from limiter for key, or explains when to try again.
+func limit(limiter *RateLimiter, kind string, key string) error {
+	if ok, wait := limiter.Allow(key); !ok {
+		return limitError(kind, key, wait)
+	}
+	return nil
+}
+
+func limitError(kind string, key string, wait time.Duration) error {
+	return &sp3.Error{
+		Code:       sp3.RATELIMITED,
+		Message:    "Too many challenges for " + kind + " " + key,
+		RetryAfter: int(math.Ceil(wait.Seconds())),
+	}
+}
+
+// senderLimitKey is the key senders are limited by. IPv6 senders are limited
+// by their /64, which a single host may hold all of.
+func senderLimitKey(sender string) string {
+	ip := net.ParseIP(sender)
+	if ip == nil || ip.To4() != nil {
+		return sender
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// redeem uses up a challenge issued for method, where the server keeps track
+// of them.
+func (s *Server) redeem(method sp3.AuthenticationMethod, challenge string) error {
+	switch method {
+	case sp3.PATHREFLECTION, sp3.DNSREFLECTION, sp3.STUNINJECTION, sp3.WEBNOTARY:
+		return s.reflections.Redeem(challenge)
+	}
+	return nil
+}
+
+// rejection is the UNAUTHORIZED reply to a sender, explaining err if it is a
+// protocol error.
+func rejection(err error) sp3.ServerMessage {
+	msg := sp3.ServerMessage{Status: sp3.UNAUTHORIZED}
+	if protoErr, ok := err.(*sp3.Error); ok {
+		msg.Error = protoErr
+	}
+	return msg
+}
+
+// watchConsent disconnects a sender once the consent it relies on ends.
+func (s *Server) watchConsent(sender *Session, grant *Grant, finished <-chan struct{}) {
+	select {
+	case <-grant.Done():
+		log.Printf("Consent for %v ended, stopping %v.", sender.Destination(), sender.RemoteAddr)
+		sender.Send(sp3.ServerMessage{Status: sp3.REVOKED})
+		s.Cleanup(sender)
+	case <-finished:
+	}
+}
+
+// watchClientConsent keeps a client informed of the traffic sent under its
+// consent, whenever it changes, and tells it when the consent ends, so that
+// it can give it again.
+func (s *Server) watchClientConsent(client *Session, grant *Grant, finished <-chan struct{}) {
+	interval := 5 * time.Second
+	if s.config.TrafficNoticeSeconds > 0 {
+		interval = time.Duration(s.config.TrafficNoticeSeconds) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := &sp3.TrafficNotice{Senders: []sp3.SenderTraffic{}}
+	for {
+		select {
+		case <-ticker.C:
+			notice := grant.Traffic()
+			if reflect.DeepEqual(notice, last) {
+				continue
 			}
+			if err := client.Send(sp3.ServerMessage{Status: sp3.OKAY, Traffic: notice}); err != nil {
+				return
+			}
+			last = notice
+		case <-grant.Done():
+			client.Send(sp3.ServerMessage{Status: sp3.REVOKED})
+			return
+		case <-finished:
+			return
 		}
 	}
 }
 
+// rechallenge periodically asks a sender to authenticate again, since the
+// evidence for methods other than WEBSOCKET only holds when it is given. A
+// sender which doesn't answer in time can't send until it does.
+func (s *Server) rechallenge(sender *Session, reauthenticated <-chan struct{}, finished <-chan struct{}) {
+	interval := time.Duration(s.config.ReauthSeconds) * time.Second
+	timeout := 30 * time.Second
+	if s.config.ReauthTimeout > 0 {
+		timeout = time.Duration(s.config.ReauthTimeout) * time.Second
+	}
+	for {
+		select {
+		case <-time.After(interval):
+		case <-finished:
+			return
+		}
+		// Forget reauthentications the sender made on its own.
+		select {
+		case <-reauthenticated:
+		default:
+		}
+		if err := sender.Send(sp3.ServerMessage{Status: sp3.REAUTHENTICATE}); err != nil {
+			return
+		}
+		select {
+		case <-reauthenticated:
+			continue
+		case <-time.After(timeout):
+		case <-finished:
+			return
+		}
+		if sender.Lapse() {
+			log.Printf("%v didn't reauthenticate, suspending.", sender.RemoteAddr)
+			sender.Send(sp3.ServerMessage{Status: sp3.SUSPENDED})
+		}
+		select {
+		case <-reauthenticated:
+			// The answer may have raced with the lapse.
+			sender.Authorize(sender.Destination())
+		case <-finished:
+			return
+		}
+	}
+}
+
+// Cleanup forgets a closed session. Consent given by the session ends with
+// it, stopping the senders which relied on it.
+func (s *Server) Cleanup(session *Session) {
+	if grant := session.Consent(); grant != nil {
+		grant.Revoke()
+	}
+	if s.sessions.Remove(session.ID) {
+		log.Printf("Closed connection from %s.", session.RemoteAddr)
+		session.Close()
+	}
+}
+
 func IPHandler(server *Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		addrHost, _, _ := net.SplitHostPort(r.RemoteAddr)
@@ -95,81 +444,233 @@ func SocketHandler(server *Server) http.Handler {
 			return
 		}
 		defer c.Close()
-		addrHost, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			return
-		}
 
-		server.destinations[r.RemoteAddr] = c
-		if _, ok := server.clientHosts[addrHost]; !ok {
-			server.clientHosts[addrHost] = c
-		}
-		senderState := sp3.SENDERHELLO
+		session := server.sessions.Register(c, r.RemoteAddr)
 		var sendStream chan<- []byte
-		challenge := ""
+		var challenges, rechallenges map[string]*Grant
+		var method sp3.AuthenticationMethod
+		destination := ""
+		registering := ""
+		var relayKey []byte // Of the sender's mailbox, while it is open
+		var authorized *Grant
+		finished := make(chan struct{})
+		reauthenticated := make(chan struct{}, 1)
 
-		defer server.Cleanup(r.RemoteAddr)
+		defer server.Cleanup(session)
+		defer close(finished)
+		defer func() {
+			if relayKey != nil {
+				server.mailbox.Close(relayKey)
+			}
+			// Grants narrowed for this sender end with it.
+			for _, grant := range challenges {
+				if grant != nil && grant.parent != nil {
+					grant.Revoke()
+				}
+			}
+			if authorized != nil && authorized.parent != nil {
+				authorized.Revoke()
+			}
+		}()
 		for {
 			msgType, msg, err := c.ReadMessage()
 			if err != nil {
 				log.Println("read err:", err)
 				break
 			}
-			if senderState == sp3.SENDERHELLO && msgType == websocket.TextMessage {
+			state := session.State()
+			if msgType == websocket.TextMessage {
+				// Clients give their consent before anything else, and may
+				// withdraw it at any point. The same connection may also act
+				// as a sender.
+				clientMsg := sp3.ClientMessage{}
+				if err := json.Unmarshal(msg, &clientMsg); err != nil {
+					log.Println("Hello err:", err)
+					break
+				}
+				if clientMsg.Revoke {
+					if grant := session.Consent(); grant != nil {
+						grant.Revoke()
+						log.Printf("%v revoked consent.", r.RemoteAddr)
+					}
+					continue
+				}
+				if clientMsg.Decision != nil {
+					server.approvals.Decide(session, *clientMsg.Decision)
+					continue
+				}
+				if clientMsg.Register != nil {
+					var reply sp3.ServerMessage
+					reply, registering = server.register(session, clientMsg.Register, registering)
+					session.Send(reply)
+					continue
+				}
+				if clientMsg.Hello != nil {
+					if grant := session.Consent(); state != sp3.SENDERHELLO || (grant != nil && !grant.Revoked()) {
+						log.Println("Repeated consent from", r.RemoteAddr)
+						session.Send(sp3.ServerMessage{Status: sp3.INVALID})
+						break
+					}
+					grant, err := NewGrant(session, clientMsg.Hello.Scope)
+					if err != nil {
+						log.Println("Consent err:", err)
+						session.Send(sp3.ServerMessage{Status: sp3.INVALID})
+						break
+					}
+					grant.Approve = clientMsg.Hello.Approve
+					session.SetConsent(grant)
+					go server.watchClientConsent(session, grant, finished)
+					log.Printf("%v consented to receive packets.", r.RemoteAddr)
+					continue
+				}
+			}
+			if state == sp3.SENDERHELLO && msgType == websocket.TextMessage {
 				hello := sp3.SenderHello{}
 				err := json.Unmarshal(msg, &hello)
 				if err != nil {
 					log.Println("Hello err:", err)
 					break
 				}
+				// Accept either address family, but compare in canonical form.
+				dest := net.ParseIP(hello.DestinationAddress)
+				if dest == nil {
+					log.Println("Hello err: bad destination", hello.DestinationAddress)
+					session.Send(sp3.ServerMessage{Status: sp3.INVALID})
+					break
+				}
+				hello.DestinationAddress = dest.String()
+				destination = hello.DestinationAddress
+				method = hello.AuthenticationMethod
 
-				chal, err := server.Authorize(hello)
+				// Approval would be read on this connection, which is busy
+				// waiting for it.
+				if grant := session.Consent(); method == sp3.WEBSOCKET && destination == session.Host && grant != nil && grant.Approve && !grant.Revoked() {
+					session.Send(rejection(&sp3.Error{Code: sp3.SENDERDENIED, Message: "A client can't approve its own connection as a sender"}))
+					break
+				}
+				// A sender on another host has its challenge relayed.
+				if method == sp3.WEBSOCKET && len(hello.PublicKey) > 0 {
+					if err = server.mailbox.Open(hello.PublicKey, destination, session); err != nil {
+						log.Println("Mailbox err:", err)
+						session.Send(rejection(err))
+						break
+					}
+					relayKey = hello.PublicKey
+				}
+				challenges, err = server.Authorize(session.Host, hello)
 				if err != nil {
 					log.Println("Authorize err:", err)
-					resp := sp3.ServerMessage{
-						Status: sp3.UNAUTHORIZED,
-					}
-					dat, _ := json.Marshal(resp)
-					c.WriteMessage(websocket.TextMessage, dat)
+					session.Send(rejection(err))
 					break
 				}
-				challenge = chal
-				senderState = sp3.HELLORECEIVED
+				session.SetState(sp3.HELLORECEIVED)
 				continue
-			} else if senderState == sp3.HELLORECEIVED && msgType == websocket.TextMessage {
+			} else if state == sp3.HELLORECEIVED && msgType == websocket.TextMessage {
 				auth := sp3.SenderAuthorization{}
 				err := json.Unmarshal(msg, &auth)
 				if err != nil {
 					log.Println("Auth err:", err)
 					break
 				}
-				if challenge != "" && challenge == auth.Challenge {
-					senderState = sp3.AUTHORIZED
+				if authDest := net.ParseIP(auth.DestinationAddress); authDest == nil || authDest.String() != destination {
+					log.Println("Auth for", auth.DestinationAddress, "does not match hello for", destination)
+					session.Send(rejection(&sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Authorization is not for " + destination}))
+					break
+				}
+				grant, ok := challenges[auth.Challenge]
+				if !ok || auth.Challenge == "" {
+					err = &sp3.Error{Code: sp3.CHALLENGEUNKNOWN, Message: "Challenge not issued"}
+				} else {
+					err = server.redeem(method, auth.Challenge)
+				}
+				if err == nil && grant != nil && grant.Client != nil {
+					// The client is told about each sender's traffic.
+					grant, err = grant.ForSender(session, method)
+				}
+				if err == nil {
+					authorized = grant
+					if relayKey != nil {
+						server.mailbox.Close(relayKey)
+						relayKey = nil
+					}
+					session.Authorize(destination)
 					// Further messages should now be considered as binary packets.
-					sendStream = CreateSpoofedStream(addrHost, auth.DestinationAddress)
+					sendStream = server.spoofer.CreateSpoofedStream(session.Host, destination, grant)
 					defer close(sendStream)
-
-					resp := sp3.ServerMessage{
-						Status: sp3.OKAY,
+					// Consent lasts as long as its grant, while other
+					// evidence needs repeating.
+					if grant != nil {
+						go server.watchConsent(session, grant, finished)
+					} else if server.config.ReauthSeconds > 0 {
+						go server.rechallenge(session, reauthenticated, finished)
 					}
-					dat, _ := json.Marshal(resp)
-					if err = c.WriteMessage(websocket.TextMessage, dat); err != nil {
+
+					if err = session.Send(sp3.ServerMessage{Status: sp3.OKAY}); err != nil {
 						break
 					}
-					log.Printf("Authorized %v to send to %v.", r.RemoteAddr, auth.DestinationAddress)
+					log.Printf("Authorized %v to send to %v.", r.RemoteAddr, destination)
 				} else {
-					log.Println("Bad Challenge from", r.RemoteAddr, " expected ", auth.Challenge, " but got ", challenge)
-					resp := sp3.ServerMessage{
-						Status: sp3.UNAUTHORIZED,
+					log.Println("Bad Challenge from", r.RemoteAddr, ":", err)
+					session.Send(rejection(err))
+					break
+				}
+				continue
+			} else if (state == sp3.AUTHORIZED || state == sp3.LAPSED) && msgType == websocket.TextMessage && method != sp3.WEBSOCKET {
+				// Reauthentication repeats the hello and authorization.
+				if rechallenges == nil {
+					hello := sp3.SenderHello{}
+					if err := json.Unmarshal(msg, &hello); err != nil {
+						log.Println("Hello err:", err)
+						break
 					}
-					dat, _ := json.Marshal(resp)
-					c.WriteMessage(websocket.TextMessage, dat)
+					if dest := net.ParseIP(hello.DestinationAddress); dest == nil || dest.String() != destination || hello.AuthenticationMethod != method {
+						log.Println("Reauthentication from", r.RemoteAddr, "does not match its authorization")
+						session.Send(sp3.ServerMessage{Status: sp3.INVALID})
+						break
+					}
+					hello.DestinationAddress = destination
+					if rechallenges, err = server.Authorize(session.Host, hello); err != nil {
+						log.Println("Authorize err:", err)
+						session.Send(rejection(err))
+						break
+					}
+					continue
+				}
+				auth := sp3.SenderAuthorization{}
+				if err := json.Unmarshal(msg, &auth); err != nil {
+					log.Println("Auth err:", err)
+					break
+				}
+				if authDest := net.ParseIP(auth.DestinationAddress); authDest == nil || authDest.String() != destination {
+					err = &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Authorization is not for " + destination}
+				} else if _, ok := rechallenges[auth.Challenge]; !ok || auth.Challenge == "" {
+					err = &sp3.Error{Code: sp3.CHALLENGEUNKNOWN, Message: "Challenge not issued"}
+				} else {
+					err = server.redeem(method, auth.Challenge)
+				}
+				if err != nil {
+					log.Println("Bad Challenge from", r.RemoteAddr, ":", err)
+					session.Send(rejection(err))
+					break
+				}
+				rechallenges = nil
+				session.Authorize(destination)
+				select {
+				case reauthenticated <- struct{}{}:
+				default:
+				}
+				if err = session.Send(sp3.ServerMessage{Status: sp3.OKAY}); err != nil {
 					break
 				}
+				log.Printf("Reauthenticated %v to send to %v.", r.RemoteAddr, destination)
 				continue
-			} else if senderState == sp3.AUTHORIZED && msgType == websocket.BinaryMessage {
+			} else if state == sp3.AUTHORIZED && msgType == websocket.BinaryMessage {
 				// Main forwarding loop.
 				sendStream <- msg
+				session.CountPacket(len(msg))
+				continue
+			} else if state == sp3.LAPSED && msgType == websocket.BinaryMessage {
+				// Dropped until the sender reauthenticates.
 				continue
 			}
 			// Else - unexpected message
@@ -179,32 +680,70 @@ func SocketHandler(server *Server) http.Handler {
 	})
 }
 
-func NewServer(conf Config) *Server {
+// NewServer creates a server which sends authorized packets through writer.
+func NewServer(conf Config, writer PacketWriter) *Server {
+	challengeTimeout := 30 * time.Second
+	if conf.ChallengeTimeout > 0 {
+		challengeTimeout = time.Duration(conf.ChallengeTimeout) * time.Second
+	}
+	rate := func(configured float64, unset float64) float64 {
+		if configured > 0 {
+			return configured
+		}
+		return unset
+	}
+	burst := conf.ChallengeBurst
+	if burst == 0 {
+		burst = 3
+	}
+	reflectors, err := NewReflectorRegistry(conf.PathReflectionFile)
+	if err != nil {
+		log.Printf("Couldn't load path reflectors: %v", err)
+	}
+	var registrar ed25519.PrivateKey
+	if conf.RegistrarKeyFile != "" {
+		if registrar, err = loadRegistrarKey(conf.RegistrarKeyFile); err != nil {
+			log.Printf("Couldn't load registrar key, not registering consent keys: %v", err)
+		}
+	}
 	server := &Server{
-		config:       conf,
-		destinations: make(map[string]*websocket.Conn),
-		clientHosts:  make(map[string]*websocket.Conn),
+		config:            conf,
+		reflectors:        reflectors,
+		spoofer:           NewSpoofer(writer),
+		sessions:          NewSessionRegistry(),
+		reflections:       NewChallengeTracker(challengeTimeout),
+		senderLimit:       NewRateLimiter(rate(conf.SenderChallengeRate, 6), burst),
+		destinationLimit:  NewRateLimiter(rate(conf.DestinationChallengeRate, 6), burst),
+		reflectorLimit:    NewRateLimiter(rate(conf.ReflectorChallengeRate, 60), burst),
+		registrar:         registrar,
+		sharedGrants:      make(map[string]*Grant),
+		spentAttestations: make(map[string]time.Time),
+		mailbox:           NewMailbox(),
+		approvals:         NewApprovals(),
 	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", conf.Port)
+	// Listen on all addresses, so that IPv6-only clients can connect.
+	addr := fmt.Sprintf(":%d", conf.Port)
 	mux := http.NewServeMux()
 	mux.Handle("/sp3", SocketHandler(server))
 	// By default serve a demo site.
 	mux.Handle("/client/", http.StripPrefix("/client/", http.FileServer(http.Dir("../demo"))))
 	mux.Handle("/ip.js", IPHandler(server))
-	mux.Handle("/pathreflection.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, conf.PathReflectionFile)
-	}))
+	mux.Handle("/pathreflection.json", server.reflectors)
+	mux.Handle("/dnsresolvers.json", DNSResolverHandler(server))
+	mux.Handle("/stunservers.json", StunServerHandler(server))
+	mux.Handle("/mailbox", MailboxHandler(server))
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/client/", 301)
 	}))
 
-	webServer := &http.Server{Addr: addr, Handler: mux}
-
-	server.webServer = *webServer
+	server.webServer = &http.Server{Addr: addr, Handler: mux}
 	return server
 }
 
+// Serve handles connections, while keeping the path reflectors up to date.
 func (s *Server) Serve() error {
+	probe := time.Duration(s.config.ReflectorProbeSeconds) * time.Second
+	defer s.reflectors.Watch(5*time.Second, probe)()
 	return s.webServer.ListenAndServe()
 }
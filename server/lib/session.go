@@ -0,0 +1,204 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/willscott/sp3"
+)
+
+// A Session is one websocket connection to the server.
+type Session struct {
+	ID         string
+	RemoteAddr string
+	Host       string // Canonical IP of the remote end
+	Created    time.Time
+
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+
+	lock        sync.Mutex
+	state       sp3.State
+	destination string
+	consent     *Grant
+
+	packets uint64
+	bytes   uint64
+}
+
+// Send writes a message to the session as JSON. Only one write may be active
+// on a websocket, so all writes to the connection should go through Send.
+func (s *Session) Send(msg interface{}) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.conn.WriteJSON(msg)
+}
+
+// Close closes the underlying connection.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Session) State() sp3.State {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+func (s *Session) SetState(state sp3.State) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+}
+
+// Destination is the address the session is authorized to send to, once it
+// is AUTHORIZED.
+func (s *Session) Destination() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.destination
+}
+
+// Authorize marks the session as allowed to send to destination.
+func (s *Session) Authorize(destination string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = sp3.AUTHORIZED
+	s.destination = destination
+}
+
+// Lapse stops an authorized session from sending until it reauthenticates.
+// It returns false if the session wasn't authorized.
+func (s *Session) Lapse() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != sp3.AUTHORIZED {
+		return false
+	}
+	s.state = sp3.LAPSED
+	return true
+}
+
+// Consent is the grant the session has made as a consenting client, if any.
+func (s *Session) Consent() *Grant {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.consent
+}
+
+func (s *Session) SetConsent(grant *Grant) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.consent = grant
+}
+
+// CountPacket records a packet forwarded for the session.
+func (s *Session) CountPacket(size int) {
+	atomic.AddUint64(&s.packets, 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+}
+
+// Counters returns the number of packets and bytes forwarded for the session.
+func (s *Session) Counters() (packets uint64, bytes uint64) {
+	return atomic.LoadUint64(&s.packets), atomic.LoadUint64(&s.bytes)
+}
+
+// A SessionRegistry tracks the active sessions of a server. It is safe for
+// concurrent use.
+type SessionRegistry struct {
+	sessions map[string]*Session
+	byHost   map[string][]*Session // In order of creation
+	sync.RWMutex
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*Session),
+		byHost:   make(map[string][]*Session),
+	}
+}
+
+// Register creates a session for a new connection.
+func (r *SessionRegistry) Register(conn *websocket.Conn, remoteAddr string) *Session {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	session := &Session{
+		ID:         uuid.New(),
+		RemoteAddr: remoteAddr,
+		Host:       host,
+		Created:    time.Now(),
+		conn:       conn,
+		state:      sp3.SENDERHELLO,
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.sessions[session.ID] = session
+	r.byHost[host] = append(r.byHost[host], session)
+	return session
+}
+
+// Remove forgets a session. It returns false if the session wasn't registered.
+func (r *SessionRegistry) Remove(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	session, ok := r.sessions[id]
+	if !ok {
+		return false
+	}
+	delete(r.sessions, id)
+	others := r.byHost[session.Host]
+	for i, other := range others {
+		if other == session {
+			others = append(others[:i:i], others[i+1:]...)
+			break
+		}
+	}
+	if len(others) == 0 {
+		delete(r.byHost, session.Host)
+	} else {
+		r.byHost[session.Host] = others
+	}
+	return true
+}
+
+func (r *SessionRegistry) Get(id string) (*Session, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	session, ok := r.sessions[id]
+	return session, ok
+}
+
+// ConsentingClients finds the sessions from a host which have consented to
+// receive spoofed packets, and not since revoked, longest-lived first.
+func (r *SessionRegistry) ConsentingClients(host string) []*Session {
+	r.RLock()
+	defer r.RUnlock()
+	clients := []*Session{}
+	for _, session := range r.byHost[host] {
+		if grant := session.Consent(); grant != nil && !grant.Revoked() {
+			clients = append(clients, session)
+		}
+	}
+	return clients
+}
+
+// Sessions returns a snapshot of the registered sessions.
+func (r *SessionRegistry) Sessions() []*Session {
+	r.RLock()
+	defer r.RUnlock()
+	all := make([]*Session, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		all = append(all, session)
+	}
+	return all
+}
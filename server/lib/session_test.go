@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	registry := NewSessionRegistry()
+	first := registry.Register(nil, "127.0.0.1:1000")
+	second := registry.Register(nil, "127.0.0.1:1001")
+	other := registry.Register(nil, "[::1]:1000")
+
+	if other.Host != "::1" {
+		t.Fatal("Host not canonicalized", other.Host)
+	}
+	if clients := registry.ConsentingClients("127.0.0.1"); len(clients) != 0 {
+		t.Fatal("Sessions are clients without consent")
+	}
+	second.SetConsent(&Grant{Client: second})
+	first.SetConsent(&Grant{Client: first})
+	if clients := registry.ConsentingClients("127.0.0.1"); len(clients) != 2 || clients[0] != first {
+		t.Fatal("Oldest session should be the first client")
+	}
+	registry.Remove(first.ID)
+	if clients := registry.ConsentingClients("127.0.0.1"); len(clients) != 1 || clients[0] != second {
+		t.Fatal("Remaining session not promoted")
+	}
+	if registry.Remove(first.ID) {
+		t.Fatal("Session removed twice")
+	}
+	registry.Remove(second.ID)
+	if clients := registry.ConsentingClients("127.0.0.1"); len(clients) != 0 {
+		t.Fatal("Removed sessions still registered")
+	}
+	if _, ok := registry.Get(other.ID); !ok || len(registry.Sessions()) != 1 {
+		t.Fatal("Unrelated session lost")
+	}
+
+	other.Authorize("::2")
+	other.CountPacket(100)
+	if other.State() != sp3.AUTHORIZED || other.Destination() != "::2" {
+		t.Fatal("Authorization not recorded")
+	}
+	if packets, bytes := other.Counters(); packets != 1 || bytes != 100 {
+		t.Fatal("Counters not recorded", packets, bytes)
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	server := NewServer(Config{}, NewMemoryWriter(0))
+	web := httptest.NewServer(SocketHandler(server))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+
+	// Clients connect and disconnect while senders ask for challenges.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			// The challenge may be sent to any of the connections.
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			conn.WriteJSON(sp3.SenderHello{DestinationAddress: "127.0.0.1"})
+			msg := sp3.ServerMessage{}
+			conn.ReadJSON(&msg)
+		}()
+	}
+	wg.Wait()
+}
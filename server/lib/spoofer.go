@@ -1,90 +1,118 @@
 package server
 
 import (
-	"encoding/hex"
+	"encoding/binary"
 	"errors"
-	"fmt"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 
 	"log"
 	"net"
 )
 
-var (
-	// If TestChannel is set, spoofed packets will be sent to it, rather than to pcap.
-	TestSpoofChannel chan []byte
-	handle           *pcap.Handle
-	ipv4Layer        layers.IPv4
-	linkHeader       []byte
-)
-var ipv4Parser *gopacket.DecodingLayerParser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ipv4Layer)
+// A Spoofer validates packets from authorized senders, and hands the ones
+// which are acceptable to its PacketWriter.
+type Spoofer struct {
+	Writer PacketWriter
+}
+
+func NewSpoofer(writer PacketWriter) *Spoofer {
+	return &Spoofer{Writer: writer}
+}
 
-func CreateSpoofedStream(source string, destination string) chan []byte {
+// CreateSpoofedStream starts forwarding packets sent on the returned channel
+// to destination, within the limits of grant. A nil grant places no limits
+// beyond the destination.
+func (s *Spoofer) CreateSpoofedStream(source string, destination string, grant *Grant) chan []byte {
 	dest := net.ParseIP(destination)
 	src := net.ParseIP(source)
 	flow := make(chan []byte)
-	go handleSpoofedStream(src, dest, flow)
+	go s.handleSpoofedStream(src, dest, grant, flow)
 	return flow
 }
 
-func handleSpoofedStream(src net.IP, dest net.IP, que chan []byte) error {
+func (s *Spoofer) handleSpoofedStream(src net.IP, dest net.IP, grant *Grant, que chan []byte) error {
+	spoof := s.SpoofIPv6Message
 	if p4 := dest.To4(); len(p4) == net.IPv4len {
-		for req := range que {
-			if err := SpoofIPv4Message(req, src, dest); err != nil {
-				log.Printf("Could not spoof message [%v->%v]: %v", src, dest, err)
-				close(que)
-				return err
-			}
+		spoof = s.SpoofIPv4Message
+	} else if p6 := dest.To16(); len(p6) != net.IPv6len {
+		for range que {
 		}
-		return nil
-	} else {
 		return errors.New("UNSUPPORTED")
 	}
-}
-
-func SetupSpoofingSockets(config Config) error {
-	var err error
 
-	handle, err = pcap.OpenLive(config.Device, 2048, false, pcap.BlockForever)
-	if err != nil {
-		return err
+	// Packets which can't be sent are dropped individually.
+	for req := range que {
+		if err := spoof(req, src, dest, grant); err != nil {
+			log.Printf("Could not spoof message [%v->%v]: %v", src, dest, err)
+		}
 	}
-	// make sure the handle doesn't queue up packets and start blocking / dying
-	handle.SetBPFFilter("ip.len > 5000")
-
-	srcBytes, _ := hex.DecodeString(config.Src)
-	dstBytes, _ := hex.DecodeString(config.Dst)
-	linkHeader = append(dstBytes, srcBytes...)
-	linkHeader = append(linkHeader, 0x08, 0) // IPv4 EtherType
-
-	//  var ipv6Layer layers.ipv6
-	//  ipv6Parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ipv6Layer)
 	return nil
 }
 
-func SpoofIPv4Message(packet []byte, realSrc net.IP, dest net.IP) error {
+func (s *Spoofer) SpoofIPv4Message(packet []byte, realSrc net.IP, dest net.IP, grant *Grant) error {
 	// Make sure destination is okay
-	decoded := []gopacket.LayerType{}
-	if err := ipv4Parser.DecodeLayers(packet, &decoded); len(decoded) != 1 {
+	ipv4Layer := layers.IPv4{}
+	if err := ipv4Layer.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
 		return err
 	}
 	if !dest.Equal(ipv4Layer.DstIP) {
 		log.Println("Intended packet was to", ipv4Layer.DstIP, "not the authorized", dest)
 		return errors.New("INVALID DESTINATION")
 	}
+	if grant != nil {
+		// Only the first fragment carries the transport header.
+		port, hasPort := uint16(0), false
+		if ipv4Layer.FragOffset == 0 {
+			port, hasPort = destinationPort(ipv4Layer.Protocol, ipv4Layer.Payload)
+		}
+		if err := grant.Permit(ipv4Layer.SrcIP, int(ipv4Layer.Protocol), port, hasPort, len(packet)); err != nil {
+			return err
+		}
+	}
 
-	if TestSpoofChannel != nil {
-		TestSpoofChannel <- packet
-		return nil
+	if err := s.Writer.WritePacket(packet); err != nil {
+		log.Println("Couldn't send packet", err)
+		return err
+	}
+	return nil
+}
+
+func (s *Spoofer) SpoofIPv6Message(packet []byte, realSrc net.IP, dest net.IP, grant *Grant) error {
+	// Make sure destination is okay
+	ipv6Layer := layers.IPv6{}
+	if err := ipv6Layer.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
+		return err
+	}
+	if ipv6Layer.Version != 6 {
+		return errors.New("NOT IPV6")
+	}
+	if !dest.Equal(ipv6Layer.DstIP) {
+		log.Println("Intended packet was to", ipv6Layer.DstIP, "not the authorized", dest)
+		return errors.New("INVALID DESTINATION")
+	}
+	if grant != nil {
+		// Extension headers are taken as the protocol, so a grant limited to
+		// TCP or UDP only passes packets without them.
+		port, hasPort := destinationPort(ipv6Layer.NextHeader, ipv6Layer.Payload)
+		if err := grant.Permit(ipv6Layer.SrcIP, int(ipv6Layer.NextHeader), port, hasPort, len(packet)); err != nil {
+			return err
+		}
 	}
 
-	if err := handle.WritePacketData(append(linkHeader, packet...)); err != nil {
+	if err := s.Writer.WritePacket(packet); err != nil {
 		log.Println("Couldn't send packet", err)
 		return err
 	}
-	log.Println(fmt.Sprintf("%d bytes sent to %v as %v from %v", len(packet), dest, ipv4Layer.SrcIP, realSrc))
 	return nil
 }
+
+// destinationPort reads the destination port of a TCP or UDP header, which
+// is in the same place for both.
+func destinationPort(protocol layers.IPProtocol, payload []byte) (uint16, bool) {
+	if (protocol != layers.IPProtocolTCP && protocol != layers.IPProtocolUDP) || len(payload) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(payload[2:4]), true
+}
@@ -11,12 +11,13 @@ import (
 
 func TestCreateSpoofedStream(t *testing.T) {
 	// Send packets to channel, rather than socket.
-	TestSpoofChannel = make(chan []byte, 5)
+	writer := NewMemoryWriter(5)
+	spoofer := NewSpoofer(writer)
 
 	to := "127.0.0.1"
 	from := "127.0.0.1"
 
-	outbound := CreateSpoofedStream(from, to)
+	outbound := spoofer.CreateSpoofedStream(from, to, nil)
 	if outbound == nil {
 		t.Fatal("Creation of spoofed stream failed.")
 	}
@@ -42,12 +43,13 @@ func TestCreateSpoofedStream(t *testing.T) {
 	}
 
 	outbound <- buf.Bytes()
-	sentPkt := <-TestSpoofChannel
+	sentPkt := <-writer.Packets
 	if !bytes.Contains(sentPkt, []byte(payload)) {
 		t.Fatal("Valid packet not spoofed")
 	}
 
 	// Send bad packet.
+	buf = gopacket.NewSerializeBuffer()
 	ip.DstIP = net.IPv4(10, 0, 0, 1)
 	if err := gopacket.SerializeLayers(buf, opts, ip, payload); err != nil {
 		t.Fatal("Couldn't construct packet")
@@ -55,7 +57,65 @@ func TestCreateSpoofedStream(t *testing.T) {
 	outbound <- buf.Bytes()
 
 	select {
-	case <-TestSpoofChannel:
+	case <-writer.Packets:
+		t.Fatal("Bad packet delivered")
+	case <-time.After(time.Second):
+		t.Log("Bad Packet lost")
+	}
+}
+
+func TestCreateSpoofedStreamIPv6(t *testing.T) {
+	// Send packets to channel, rather than socket.
+	writer := NewMemoryWriter(5)
+	spoofer := NewSpoofer(writer)
+
+	to := "::1"
+	from := "::1"
+
+	outbound := spoofer.CreateSpoofedStream(from, to, nil)
+	if outbound == nil {
+		t.Fatal("Creation of spoofed stream failed.")
+	}
+
+	// Send legit packet.
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("::1"),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(443),
+		DstPort: layers.UDPPort(8080),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	payload := gopacket.Payload([]byte("This is a test packet..."))
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, payload); err != nil {
+		t.Fatal("Couldn't construct packet")
+	}
+
+	outbound <- buf.Bytes()
+	sentPkt := <-writer.Packets
+	if !bytes.Contains(sentPkt, []byte(payload)) {
+		t.Fatal("Valid packet not spoofed")
+	}
+
+	// Send bad packet.
+	buf = gopacket.NewSerializeBuffer()
+	ip.DstIP = net.ParseIP("2001:db8::2")
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, payload); err != nil {
+		t.Fatal("Couldn't construct packet")
+	}
+	outbound <- buf.Bytes()
+
+	select {
+	case <-writer.Packets:
 		t.Fatal("Bad packet delivered")
 	case <-time.After(time.Second):
 		t.Log("Bad Packet lost")
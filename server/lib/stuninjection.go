@@ -0,0 +1,134 @@
+/**
+ * This file is part of the SP^3 server, implementing the "Listening socket"
+ * form of IP verification - namely a spoofed STUN Binding Response, sent to
+ * the UDP binding the client opened with a STUN server, with the challenge as
+ * its transaction ID.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/willscott/sp3"
+)
+
+type StunInjectionState struct {
+	ServerIP   net.IP // The STUN server the client asked
+	ServerPort uint16
+	ClientIP   net.IP // The client's address, as the STUN server saw it
+	ClientPort uint16
+}
+
+// Validate checks that the state describes a binding of destination, so that
+// the response is only ever sent to the destination.
+func (state *StunInjectionState) Validate(destination string) error {
+	if state.ClientIP == nil || state.ServerIP == nil {
+		return &sp3.Error{Code: sp3.MALFORMEDOPTIONS, Message: "Client and server addresses are required"}
+	}
+	if !state.ClientIP.Equal(net.ParseIP(destination)) {
+		return &sp3.Error{Code: sp3.DESTINATIONMISMATCH, Message: "Client address must be the destination"}
+	}
+	if !routableUnicast(state.ClientIP) || !routableUnicast(state.ServerIP) {
+		return &sp3.Error{Code: sp3.UNROUTABLEADDRESS, Message: "Addresses must be routable IPv4 unicast"}
+	}
+	if state.ServerPort == 0 {
+		return &sp3.Error{Code: sp3.BADPORT, Message: "Server port is required"}
+	}
+	if state.ClientPort < 1024 {
+		return &sp3.Error{Code: sp3.BADPORT, Message: "Client port must be unprivileged"}
+	}
+	return nil
+}
+
+// The port of STUN servers configured without one.
+const defaultStunPort = 3478
+
+// trustedStunServer is true for the STUN servers in the config, given as
+// ip:port, or an address alone for the default port.
+func (s *Server) trustedStunServer(ip net.IP, port uint16) bool {
+	for _, server := range s.config.StunServers {
+		host, portString, err := net.SplitHostPort(server)
+		trustedPort := uint64(defaultStunPort)
+		if err != nil {
+			host = server
+		} else if trustedPort, err = strconv.ParseUint(portString, 10, 16); err != nil {
+			continue
+		}
+		if ip.Equal(net.ParseIP(host)) && uint64(port) == trustedPort {
+			return true
+		}
+	}
+	return false
+}
+
+// StunServerHandler publishes the STUN servers trusted for STUN injection.
+func StunServerHandler(server *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servers := server.config.StunServers
+		if servers == nil {
+			servers = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(servers)
+	})
+}
+
+// key identifies the binding the state describes.
+func (state *StunInjectionState) key() string {
+	return fmt.Sprintf("stun %v:%d-%v:%d", state.ClientIP, state.ClientPort, state.ServerIP, state.ServerPort)
+}
+
+// SendStunChallenge sends the client a Binding Response from the STUN server
+// in state, whose transaction ID is a new challenge. The challenge is the hex
+// encoding of the ID, and can be redeemed once.
+func (s *Server) SendStunChallenge(state *StunInjectionState) (string, error) {
+	var id sp3.StunTransactionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(id[:])
+	if err := s.reflections.issue(state.key(), token); err != nil {
+		return "", err
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    state.ServerIP,
+		DstIP:    state.ClientIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(state.ServerPort),
+		DstPort: layers.UDPPort(state.ClientPort),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	mapped := &net.UDPAddr{IP: state.ClientIP, Port: int(state.ClientPort)}
+	payload := gopacket.Payload(sp3.StunBindingResponse(id, mapped))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths:       true,
+	}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, payload); err != nil {
+		s.reflections.Cancel(token)
+		return "", err
+	}
+
+	if err := s.spoofer.SpoofIPv4Message(buf.Bytes(), state.ServerIP, state.ClientIP, nil); err != nil {
+		s.reflections.Cancel(token)
+		return "", err
+	}
+	return token, nil
+}
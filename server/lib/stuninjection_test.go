@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/gorilla/websocket"
+
+	"github.com/willscott/sp3"
+)
+
+func TestStunInjection(t *testing.T) {
+	writer := NewMemoryWriter(1)
+	conf := Config{PathReflectionFile: "../pathreflection.json", StunServers: []string{"74.125.250.129:19302"}}
+	web := httptest.NewServer(SocketHandler(NewServer(conf, writer)))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+	hello := func(server string, port uint16) *websocket.Conn {
+		sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, _ := json.Marshal(&StunInjectionState{
+			ServerIP:   net.ParseIP(server),
+			ServerPort: port,
+			ClientIP:   net.ParseIP("1.2.3.4"),
+			ClientPort: 40000,
+		})
+		sender.WriteJSON(sp3.SenderHello{
+			DestinationAddress:    "1.2.3.4",
+			AuthenticationMethod:  sp3.STUNINJECTION,
+			AuthenticationOptions: opts,
+		})
+		return sender
+	}
+
+	// Responses are only spoofed from trusted STUN servers.
+	for _, untrusted := range []struct {
+		server string
+		port   uint16
+	}{{"8.8.8.8", 19302}, {"74.125.250.129", 3478}} {
+		sender := hello(untrusted.server, untrusted.port)
+		msg := sp3.ServerMessage{}
+		if err := sender.ReadJSON(&msg); err != nil || msg.Error == nil || msg.Error.Code != sp3.UNTRUSTEDREFLECTOR {
+			t.Fatal("Untrusted STUN server used", untrusted, msg, err)
+		}
+		sender.Close()
+	}
+
+	sender := hello("74.125.250.129", 19302)
+	defer sender.Close()
+
+	var challenge string
+	select {
+	case packet := <-writer.Packets:
+		decoded := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+		ip, _ := decoded.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, _ := decoded.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if ip == nil || udp == nil || !ip.DstIP.Equal(net.ParseIP("1.2.3.4")) || udp.DstPort != 40000 || udp.SrcPort != 19302 {
+			t.Fatal("Response not sent to the binding", decoded)
+		}
+		id, mapped, err := sp3.ParseStunBindingResponse(udp.Payload)
+		if err != nil || mapped == nil || mapped.Port != 40000 || !mapped.IP.Equal(net.ParseIP("1.2.3.4")) {
+			t.Fatal("Bad STUN response", mapped, err)
+		}
+		challenge = hex.EncodeToString(id[:])
+	case <-time.After(time.Second):
+		t.Fatal("STUN response not sent")
+	}
+
+	sender.WriteJSON(sp3.SenderAuthorization{DestinationAddress: "1.2.3.4", Challenge: challenge})
+	msg := sp3.ServerMessage{}
+	if err := sender.ReadJSON(&msg); err != nil || msg.Status != sp3.OKAY {
+		t.Fatal("Injected challenge not accepted", msg.Status, err)
+	}
+}
+
+func TestStunInjectionValidate(t *testing.T) {
+	valid := func() *StunInjectionState {
+		return &StunInjectionState{
+			ServerIP:   net.ParseIP("74.125.250.129"),
+			ServerPort: 19302,
+			ClientIP:   net.ParseIP("1.2.3.4"),
+			ClientPort: 40000,
+		}
+	}
+	if err := valid().Validate("1.2.3.4"); err != nil {
+		t.Fatal("Valid state rejected", err)
+	}
+	cases := []struct {
+		change func(*StunInjectionState)
+		code   sp3.ErrorCode
+	}{
+		{func(s *StunInjectionState) { s.ClientIP = net.ParseIP("5.6.7.8") }, sp3.DESTINATIONMISMATCH},
+		{func(s *StunInjectionState) { s.ServerIP = nil }, sp3.MALFORMEDOPTIONS},
+		{func(s *StunInjectionState) { s.ServerIP = net.ParseIP("127.0.0.1") }, sp3.UNROUTABLEADDRESS},
+		{func(s *StunInjectionState) { s.ServerPort = 0 }, sp3.BADPORT},
+		{func(s *StunInjectionState) { s.ClientPort = 80 }, sp3.BADPORT},
+	}
+	for i, c := range cases {
+		state := valid()
+		c.change(state)
+		err, ok := state.Validate("1.2.3.4").(*sp3.Error)
+		if !ok || err.Code != c.code {
+			t.Fatalf("Case %d: expected %v, got %v", i, c.code, err)
+		}
+	}
+}
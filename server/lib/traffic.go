@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net"
+
+	"github.com/willscott/sp3"
+)
+
+// Clients are told the prefixes of up to this many sources for each sender.
+const maxTrafficPrefixes = 32
+
+// senderAccount is what a grant for one sender records for the client.
+type senderAccount struct {
+	sender  *Session
+	method  sp3.AuthenticationMethod
+	senders []*Grant // Of a client's grant, those authorized under it
+	sources []string
+}
+
+// ForSender is the grant sender is authorized under by method, which keeps
+// account of its traffic for the client. Each sender gets one of its own,
+// narrowed from the client's grant if it wasn't already.
+func (g *Grant) ForSender(sender *Session, method sp3.AuthenticationMethod) (*Grant, error) {
+	child := g
+	if g.parent == nil {
+		var err error
+		if child, err = g.Narrow(sp3.ConsentScope{}); err != nil {
+			return nil, err
+		}
+	}
+	child.Lock()
+	child.account.sender = sender
+	child.account.method = method
+	child.Unlock()
+
+	parent := child.parent
+	parent.Lock()
+	defer parent.Unlock()
+	if !child.Revoked() {
+		parent.account.senders = append(parent.account.senders, child)
+	}
+	return child, nil
+}
+
+func (g *Grant) removeSender(child *Grant) {
+	g.Lock()
+	defer g.Unlock()
+	for i, sender := range g.account.senders {
+		if sender == child {
+			g.account.senders = append(g.account.senders[0:i], g.account.senders[i+1:]...)
+			return
+		}
+	}
+}
+
+// Drop counts a packet which wasn't sent under the grant.
+func (g *Grant) Drop() {
+	for grant := g; grant != nil; grant = grant.parent {
+		grant.Lock()
+		grant.dropped++
+		grant.Unlock()
+	}
+}
+
+// addSource notes the prefix a sent packet claimed to come from, a /24 for
+// IPv4 and a /48 for IPv6.
+func (g *Grant) addSource(src net.IP) {
+	var prefix net.IPNet
+	if ip4 := src.To4(); ip4 != nil {
+		prefix = net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	} else {
+		prefix = net.IPNet{IP: src.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}
+	}
+	g.Lock()
+	defer g.Unlock()
+	if len(g.account.sources) >= maxTrafficPrefixes {
+		return
+	}
+	for _, source := range g.account.sources {
+		if source == prefix.String() {
+			return
+		}
+	}
+	g.account.sources = append(g.account.sources, prefix.String())
+}
+
+// Traffic describes what has been sent under a client's grant, and by each
+// of the senders authorized under it.
+func (g *Grant) Traffic() *sp3.TrafficNotice {
+	g.Lock()
+	notice := &sp3.TrafficNotice{
+		Packets: g.packets,
+		Bytes:   g.bytes,
+		Dropped: g.dropped,
+		Senders: []sp3.SenderTraffic{},
+	}
+	senders := append([]*Grant{}, g.account.senders...)
+	g.Unlock()
+
+	for _, sender := range senders {
+		sender.Lock()
+		notice.Senders = append(notice.Senders, sp3.SenderTraffic{
+			Session:        sender.account.sender.ID,
+			Sender:         sender.account.sender.Host,
+			Method:         sender.account.method,
+			Packets:        sender.packets,
+			Bytes:          sender.bytes,
+			Dropped:        sender.dropped,
+			SourcePrefixes: append([]string{}, sender.account.sources...),
+		})
+		sender.Unlock()
+	}
+	return notice
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/willscott/sp3"
+)
+
+func TestTrafficNotices(t *testing.T) {
+	writer := NewMemoryWriter(5)
+	server := NewServer(Config{TrafficNoticeSeconds: 1}, writer)
+	web := httptest.NewServer(SocketHandler(server))
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http")
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteJSON(sp3.ClientMessage{Hello: &sp3.ClientHello{Scope: sp3.ConsentScope{Ports: []uint16{5000}}}})
+	time.Sleep(50 * time.Millisecond)
+
+	sender := authorizeSender(t, url, client)
+	dest := net.ParseIP("127.0.0.1")
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 5000))
+	sender.WriteMessage(websocket.BinaryMessage, udpPacket(t, dest, 6000))
+	<-writer.Packets
+
+	notice := func() *sp3.TrafficNotice {
+		msg := sp3.ServerMessage{}
+		client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if err := client.ReadJSON(&msg); err != nil || msg.Traffic == nil {
+			t.Fatal("No traffic notice", msg, err)
+		}
+		return msg.Traffic
+	}
+	traffic := notice()
+	if traffic.Packets != 1 || traffic.Dropped != 1 || len(traffic.Senders) != 1 {
+		t.Fatal("Traffic not reported", traffic)
+	}
+	if s := traffic.Senders[0]; s.Sender != "127.0.0.1" || s.Method != sp3.WEBSOCKET || s.Packets != 1 || s.Dropped != 1 ||
+		len(s.SourcePrefixes) != 1 || s.SourcePrefixes[0] != "127.0.0.0/24" {
+		t.Fatal("Sender's traffic not reported", s)
+	}
+
+	// Senders which leave are no longer listed.
+	sender.Close()
+	traffic = notice()
+	if traffic.Packets != 1 || len(traffic.Senders) != 0 {
+		t.Fatal("Departed sender still reported", traffic)
+	}
+}
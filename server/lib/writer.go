@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PacketWriter is an egress path for spoofed packets. Packets passed to it
+// are complete layer 3 packets, beginning with the IP header.
+type PacketWriter interface {
+	WritePacket(packet []byte) error
+	Close() error
+}
+
+// Names of the egress backends which can be selected in Config.Backend.
+const (
+	PcapBackend = "pcap"
+	RawBackend  = "raw"
+	FileBackend = "file"
+)
+
+// NewPacketWriter opens the egress backend described by a server config,
+// batching its writes if the config asks for it.
+func NewPacketWriter(config Config) (PacketWriter, error) {
+	writer, err := openBackend(config)
+	if err != nil || config.BatchSize <= 1 {
+		return writer, err
+	}
+	interval := time.Duration(config.BatchFlushMillis) * time.Millisecond
+	return NewBatchWriter(writer, config.BatchSize, interval), nil
+}
+
+func openBackend(config Config) (PacketWriter, error) {
+	switch config.Backend {
+	case "", PcapBackend:
+		return openPcap(config)
+	case RawBackend:
+		writer, err := NewRawSocketWriter()
+		if err == nil {
+			return writer, nil
+		}
+		log.Printf("Raw socket backend unavailable (%v), falling back to pcap", err)
+		pcapWriter, pcapErr := openPcap(config)
+		if pcapErr != nil {
+			return nil, errors.New(err.Error() + "; pcap fallback: " + pcapErr.Error())
+		}
+		return pcapWriter, nil
+	case FileBackend:
+		return NewPcapFileWriter(config.DumpFile)
+	default:
+		return nil, errors.New("Unknown backend: " + config.Backend)
+	}
+}
+
+// openPcap uses the configured link addresses if there are any, and otherwise
+// looks up the next hop for each packet. Fixed addresses belong to one
+// interface, so they need a Device too.
+func openPcap(config Config) (PacketWriter, error) {
+	if isUnsetMAC(config.Src) || isUnsetMAC(config.Dst) {
+		return NewRoutedPcapWriter(config.Device, config.VLAN)
+	}
+	if config.Device == "" {
+		return nil, errNoDevice
+	}
+	return NewPcapWriter(config.Device, config.Src, config.Dst, config.VLAN)
+}
+
+var errNoDevice = errors.New("Src and Dst MAC addresses need a Device to send from")
+
+func isUnsetMAC(mac string) bool {
+	return strings.Trim(mac, "0:") == ""
+}
+
+// parseMAC reads an Ethernet address, written with separators as
+// net.ParseMAC takes them, or as bare hex.
+func parseMAC(mac string) (net.HardwareAddr, error) {
+	addr, err := net.ParseMAC(mac)
+	if err != nil {
+		addr, err = hex.DecodeString(mac)
+	}
+	if err != nil || len(addr) != 6 {
+		return nil, errors.New("Bad Ethernet address " + mac)
+	}
+	return addr, nil
+}
+
+var errNotIP = errors.New("Not an IP packet")
+
+// ipVersion is the IP version of a packet long enough to hold its header.
+func ipVersion(packet []byte) int {
+	if len(packet) >= 20 && packet[0]>>4 == 4 {
+		return 4
+	} else if len(packet) >= 40 && packet[0]>>4 == 6 {
+		return 6
+	}
+	return 0
+}
+
+// A MemoryWriter keeps spoofed packets in process, delivering them to the
+// Packets channel rather than to the network.
+type MemoryWriter struct {
+	Packets chan []byte
+	closed  bool
+	sync.Mutex
+}
+
+func NewMemoryWriter(size int) *MemoryWriter {
+	return &MemoryWriter{Packets: make(chan []byte, size)}
+}
+
+func (m *MemoryWriter) WritePacket(packet []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return errors.New("Writer closed")
+	}
+	m.Packets <- append([]byte{}, packet...)
+	return nil
+}
+
+func (m *MemoryWriter) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.Packets)
+	}
+	return nil
+}
@@ -15,9 +15,17 @@ var (
 	configFile *string = flag.String("config", "", "File with server configuration")
 	initFlag   *bool   = flag.Bool("init", false, "if true, setup new configuration")
 	port       *int    = flag.Int("port", 8080, "TCP port for connections")
-	device     *string = flag.String("device", "eth0", "inet device for pcap to use")
-	srcMAC     *string = flag.String("srcMAC", "000000000000", "Ethernet SRC for sending")
-	dstMAC     *string = flag.String("dstMAC", "000000000000", "Ethernet DST for sending")
+	device     *string = flag.String("device", "", "inet device for pcap to use (default: chosen by route)")
+	srcMAC     *string = flag.String("srcMAC", "", "Ethernet SRC for sending (default: from interface)")
+	dstMAC     *string = flag.String("dstMAC", "", "Ethernet DST for sending (default: from neighbor cache)")
+	vlan       *int    = flag.Int("vlan", 0, "802.1Q VLAN tag for Ethernet devices (0 for untagged)")
+	backend    *string = flag.String("backend", "pcap", "Egress for spoofed packets (pcap, raw or file)")
+	dumpFile   *string = flag.String("dump", "sp3.pcap", "Where the file backend records packets")
+	batchSize  *int    = flag.Int("batch", 0, "Number of packets to send at once (0 to disable batching)")
+	batchFlush *int    = flag.Int("flush", 10, "Milliseconds a packet may wait for its batch to fill")
+	reauth     *int    = flag.Int("reauth", 300, "Seconds between reauthentications of non-websocket senders (0 to disable)")
+	reauthWait *int    = flag.Int("reauthTimeout", 30, "Seconds a sender has to reauthenticate before it is suspended")
+	probe      *int    = flag.Int("probe", 600, "Seconds between checks that path reflectors still work (0 to disable)")
 )
 
 func main() {
@@ -42,11 +50,19 @@ func main() {
 			return
 		}
 		defaultConfig, _ := json.Marshal(server.Config{
-			Port:               *port,
-			Device:             *device,
-			Src:                *srcMAC,
-			Dst:                *dstMAC,
-			PathReflectionFile: "pathreflection.json",
+			Port:                  *port,
+			Device:                *device,
+			Src:                   *srcMAC,
+			Dst:                   *dstMAC,
+			VLAN:                  *vlan,
+			PathReflectionFile:    "pathreflection.json",
+			Backend:               *backend,
+			DumpFile:              *dumpFile,
+			BatchSize:             *batchSize,
+			BatchFlushMillis:      *batchFlush,
+			ReauthSeconds:         *reauth,
+			ReauthTimeout:         *reauthWait,
+			ReflectorProbeSeconds: *probe,
 		})
 		if _, err := configHandle.Write(defaultConfig); err != nil {
 			log.Fatalf("Failed to write default config: %s", err)
@@ -70,18 +86,20 @@ func main() {
 	if config.Port == 0 {
 		config.Port = 8080
 	}
-	if config.Device == "" {
-		config.Device = "eth0"
-	}
 	if config.PathReflectionFile == "" {
 		config.PathReflectionFile = "pathreflection.json"
 	}
+	if config.Backend == server.FileBackend && config.DumpFile == "" {
+		config.DumpFile = "sp3.pcap"
+	}
 
 	fmt.Printf("Using config %+v \n", config)
-	if err = server.SetupSpoofingSockets(config); err != nil {
+	writer, err := server.NewPacketWriter(config)
+	if err != nil {
 		log.Fatalf("Could not initialize sockets: %s", err)
 		return
 	}
-	s := server.NewServer(config)
+	defer writer.Close()
+	s := server.NewServer(config, writer)
 	s.Serve()
 }
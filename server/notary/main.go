@@ -0,0 +1,56 @@
+// Command notary is a reference web notary for SP^3. It answers each request
+// with a signed attestation of the address it came from, which SP^3 servers
+// trusting its key accept as proof of that address.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/willscott/sp3/server/lib"
+)
+
+var (
+	port         *int    = flag.Int("port", 8081, "Listening port")
+	keyFile      *string = flag.String("key", "notary.key", "File holding the signing key")
+	initKey      *bool   = flag.Bool("init", false, "Create a new signing key")
+	forwardedFor *string = flag.String("forwardedFor", "", "Header a trusted front end puts the client address in, such as X-Forwarded-For")
+)
+
+func main() {
+	flag.Parse()
+
+	if *initKey {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("Couldn't generate key: %s", err)
+		}
+		encoded := base64.StdEncoding.EncodeToString(key.Seed())
+		if err = ioutil.WriteFile(*keyFile, []byte(encoded+"\n"), 0600); err != nil {
+			log.Fatalf("Couldn't write key: %s", err)
+		}
+	}
+
+	encoded, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("Couldn't read key, create one with --init: %s", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatalf("Bad key in %s", *keyFile)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	fmt.Fprintf(os.Stderr, "Notary key, for NotaryKeys in the server config: %s\n",
+		base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+
+	http.Handle("/", server.NotaryHandler(key, *forwardedFor))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
@@ -0,0 +1,110 @@
+// Command qualify tries candidate path reflectors, and writes the ones which
+// work to a pathreflection.json for the SP^3 server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/willscott/sp3"
+	"github.com/willscott/sp3/server/lib"
+)
+
+var (
+	output     *string = flag.String("o", "pathreflection.json", "Where to write the qualified reflectors")
+	merge      *bool   = flag.Bool("merge", false, "Keep the reflectors already in the output file")
+	protocol   *string = flag.String("protocol", "http", "Protocol of the candidates: http, smtp or ftp")
+	port       *int    = flag.Int("port", 0, "TCP port of the candidates (default: the protocol's own)")
+	method     *string = flag.String("method", "", "Request method, or command for smtp and ftp (default: GET, EHLO or USER)")
+	path       *string = flag.String("path", "", "Request path, or command argument, where {token} is replaced by the challenge (default: /sp3.{token}/ or sp3.{token})")
+	version    *string = flag.String("version", "", "HTTP version of the request (default: HTTP/1.0)")
+	extraction *string = flag.String("extraction", "", "Regular expression finding the challenge in the response (default: sp3.<token>)")
+	maxSize    *int    = flag.Int("maxSize", 65536, "Largest acceptable response, in bytes")
+	timeout    *int    = flag.Int("timeout", 10, "Seconds to wait for each candidate")
+)
+
+// candidateIPs finds the IPv4 addresses to try for a host name or address.
+func candidateIPs(candidate string) ([]string, error) {
+	if ip := net.ParseIP(candidate); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	addrs, err := net.LookupIP(candidate)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			ips = append(ips, addr.String())
+		}
+	}
+	return ips, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] host-or-ip...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	reflectors := make(map[string]sp3.ReflectorProfile)
+	if *merge {
+		if data, err := ioutil.ReadFile(*output); err == nil {
+			if err = json.Unmarshal(data, &reflectors); err != nil {
+				log.Fatalf("Couldn't parse %s: %s", *output, err)
+			}
+		}
+	}
+
+	qualified := 0
+	for _, candidate := range flag.Args() {
+		ips, err := candidateIPs(candidate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", candidate, err)
+			continue
+		}
+		profile := sp3.ReflectorProfile{
+			Protocol:   sp3.ReflectorProtocol(*protocol),
+			Port:       uint16(*port),
+			Method:     *method,
+			Path:       *path,
+			Version:    *version,
+			Extraction: *extraction,
+		}
+		if profile.Protocol == sp3.HTTP {
+			profile.Host = candidate
+		}
+		for _, ip := range ips {
+			q, err := server.QualifyReflector(ip, profile, time.Duration(*timeout)*time.Second)
+			if err == nil {
+				err = q.Problem(*maxSize)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s (%s): %s\n", candidate, ip, err)
+				continue
+			}
+			fmt.Printf("%s (%s): qualified, %d byte response\n", candidate, ip, q.ResponseSize)
+			reflectors[ip] = profile
+			qualified++
+		}
+	}
+
+	if qualified == 0 {
+		log.Fatalf("No candidates qualified, not writing %s", *output)
+	}
+	if err := server.WriteReflectorFile(*output, reflectors); err != nil {
+		log.Fatalf("Couldn't write %s: %s", *output, err)
+	}
+	fmt.Printf("Wrote %d reflectors to %s\n", len(reflectors), *output)
+}
@@ -0,0 +1,98 @@
+package sp3
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// STUN messages (RFC 5389) are used by the STUNINJECTION method, where the
+// challenge is the transaction ID of a Binding Response.
+const (
+	stunMagicCookie       = 0x2112A442
+	stunHeaderSize        = 20
+	stunBindingRequest    = 0x0001
+	stunBindingSuccess    = 0x0101
+	stunMappedAddress     = 0x0001
+	stunXorMappedAddress  = 0x0020
+	stunAddressFamilyIPv4 = 0x01
+)
+
+// A StunTransactionID matches a STUN response to its request.
+type StunTransactionID [12]byte
+
+func stunMessage(msgType uint16, id StunTransactionID, attributes []byte) []byte {
+	msg := make([]byte, stunHeaderSize, stunHeaderSize+len(attributes))
+	binary.BigEndian.PutUint16(msg[0:], msgType)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(attributes)))
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], id[:])
+	return append(msg, attributes...)
+}
+
+// StunBindingRequest asks a STUN server for the address it sees the request
+// come from.
+func StunBindingRequest(id StunTransactionID) []byte {
+	return stunMessage(stunBindingRequest, id, nil)
+}
+
+// StunBindingResponse tells the client of request id that it was seen from
+// mapped, an IPv4 address.
+func StunBindingResponse(id StunTransactionID, mapped *net.UDPAddr) []byte {
+	attribute := make([]byte, 12)
+	binary.BigEndian.PutUint16(attribute[0:], stunXorMappedAddress)
+	binary.BigEndian.PutUint16(attribute[2:], 8)
+	attribute[5] = stunAddressFamilyIPv4
+	binary.BigEndian.PutUint16(attribute[6:], uint16(mapped.Port)^uint16(stunMagicCookie>>16))
+	binary.BigEndian.PutUint32(attribute[8:], binary.BigEndian.Uint32(mapped.IP.To4())^stunMagicCookie)
+	return stunMessage(stunBindingSuccess, id, attribute)
+}
+
+// ParseStunBindingResponse reads the transaction ID of a Binding Response, and
+// the address it maps the client to, which is nil if it doesn't give an IPv4
+// one.
+func ParseStunBindingResponse(msg []byte) (StunTransactionID, *net.UDPAddr, error) {
+	var id StunTransactionID
+	if len(msg) < stunHeaderSize || binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie {
+		return id, nil, errors.New("Not a STUN message")
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != stunBindingSuccess {
+		return id, nil, errors.New("Not a STUN Binding Response")
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if len(msg) < stunHeaderSize+length {
+		return id, nil, errors.New("STUN message truncated")
+	}
+	copy(id[:], msg[8:stunHeaderSize])
+
+	var mapped *net.UDPAddr
+	attributes := msg[stunHeaderSize : stunHeaderSize+length]
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:])
+		attrLength := int(binary.BigEndian.Uint16(attributes[2:]))
+		if len(attributes) < 4+attrLength {
+			break
+		}
+		value := attributes[4 : 4+attrLength]
+		if len(value) == 8 && value[1] == stunAddressFamilyIPv4 {
+			port := binary.BigEndian.Uint16(value[2:])
+			ip := binary.BigEndian.Uint32(value[4:])
+			if attrType == stunXorMappedAddress {
+				port ^= uint16(stunMagicCookie >> 16)
+				ip ^= stunMagicCookie
+				mapped = &net.UDPAddr{IP: make(net.IP, 4), Port: int(port)}
+				binary.BigEndian.PutUint32(mapped.IP, ip)
+			} else if attrType == stunMappedAddress && mapped == nil {
+				mapped = &net.UDPAddr{IP: make(net.IP, 4), Port: int(port)}
+				binary.BigEndian.PutUint32(mapped.IP, ip)
+			}
+		}
+		// Attributes are padded to a multiple of 4 bytes.
+		next := 4 + (attrLength+3)/4*4
+		if next > len(attributes) {
+			break
+		}
+		attributes = attributes[next:]
+	}
+	return id, mapped, nil
+}